@@ -4,11 +4,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/mattermost/mattermost-push-proxy/server"
 )
@@ -26,6 +29,17 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "deadletter":
+			os.Exit(runDeadLetterCommand(cfg, flag.Args()[1:]))
+		case "usage":
+			os.Exit(runUsageCommand(cfg, flag.Args()[1:]))
+		default:
+			log.Fatalf("unknown command %q", flag.Arg(0))
+		}
+	}
+
 	logger := server.NewLogger(cfg)
 	logger.Info("Loading " + fileName)
 
@@ -40,3 +54,121 @@ func main() {
 
 	srv.Stop()
 }
+
+const deadLetterUsage = `usage: mattermost-push-proxy [-config file] deadletter <list|replay> [flags]
+
+  list     print the dead letters matching the flags as JSON lines
+  replay   send the dead letters matching the flags again through the
+           configured push targets, dropping the delivered ones
+`
+
+// runDeadLetterCommand inspects or replays cfg.DeadLetterFile and returns the
+// process exit code.
+func runDeadLetterCommand(cfg *server.ConfigPushProxy, args []string) int {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "replay") {
+		fmt.Fprint(os.Stderr, deadLetterUsage)
+		return 2
+	}
+	if cfg.DeadLetterFile == "" {
+		fmt.Fprintln(os.Stderr, "DeadLetterFile is not configured")
+		return 1
+	}
+
+	var filter server.DeadLetterFilter
+	var since time.Duration
+	flags := flag.NewFlagSet("deadletter "+args[0], flag.ContinueOnError)
+	flags.StringVar(&filter.Type, "type", "", "only the given push target type")
+	flags.StringVar(&filter.ServerID, "server", "", "only the given server ID")
+	flags.StringVar(&filter.Reason, "reason", "", "only the given failure reason")
+	flags.DurationVar(&since, "since", 0, "only failures newer than this, e.g. 2h")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if since > 0 {
+		filter.Since = time.Now().Add(-since)
+	}
+
+	if args[0] == "replay" {
+		logger := server.NewLogger(cfg)
+		delivered, failed, err := server.ReplayDeadLetters(cfg, logger, &filter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to replay dead letters: %v\n", err)
+			return 1
+		}
+		fmt.Printf("delivered=%v failed=%v\n", delivered, failed)
+		if failed > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	letters, _, err := server.ReadDeadLetters(cfg.DeadLetterFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read dead letters: %v\n", err)
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, letter := range letters {
+		if filter.Match(letter) {
+			_ = encoder.Encode(letter)
+		}
+	}
+	return 0
+}
+
+const usageUsage = `usage: mattermost-push-proxy [-config file] usage [flags]
+
+  print the per-server usage counters stored in UsageFile, as of their
+  last write, for the given date range
+`
+
+// runUsageCommand exports cfg.UsageFile and returns the process exit code.
+func runUsageCommand(cfg *server.ConfigPushProxy, args []string) int {
+	if cfg.UsageFile == "" {
+		fmt.Fprintln(os.Stderr, "UsageFile is not configured")
+		return 1
+	}
+
+	var filter server.UsageFilter
+	var format string
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usageUsage)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&filter.ServerID, "server", "", "only the given server ID")
+	flags.StringVar(&filter.From, "from", "", "first day, as YYYY-MM-DD")
+	flags.StringVar(&filter.To, "to", "", "last day, as YYYY-MM-DD")
+	flags.StringVar(&format, "format", "csv", "csv or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := filter.IsValid(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	records, err := server.ReadUsage(cfg.UsageFile, &filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read usage: %v\n", err)
+		return 1
+	}
+
+	switch format {
+	case "csv":
+		err = server.WriteUsageCSV(os.Stdout, records)
+	case "json":
+		if records == nil {
+			records = []*server.UsageRecord{}
+		}
+		err = json.NewEncoder(os.Stdout).Encode(records)
+	default:
+		fmt.Fprintln(os.Stderr, "format must be csv or json")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write usage: %v\n", err)
+		return 1
+	}
+	return 0
+}
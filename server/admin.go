@@ -0,0 +1,193 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	HEADER_AUTHORIZATION = "Authorization"
+	AUTH_BEARER_PREFIX   = "Bearer "
+)
+
+type WechatDeviceBinding struct {
+	DeviceID string `json:"device_id"`
+	OpenID   string `json:"openid"`
+}
+
+// initAdminRoutes mounts the admin API under /admin of the given API router.
+// It is disabled unless an AdminToken is configured.
+func (s *Server) initAdminRoutes(api *mux.Router) {
+	if s.cfg.AdminToken == "" {
+		return
+	}
+
+	r := api.PathPrefix("/admin").Subrouter()
+	r.Use(s.adminAuthMiddleware)
+	r.HandleFunc("/wechat/{type}/devices", s.handleListWechatDevices).Methods("GET")
+	r.HandleFunc("/wechat/{type}/devices", s.handleSetWechatDevice).Methods("POST")
+	r.HandleFunc("/wechat/{type}/devices/{device_id}", s.handleRemoveWechatDevice).Methods("DELETE")
+	r.HandleFunc("/servers", s.handleListServers).Methods("GET")
+	r.HandleFunc("/servers/{server_id}", s.handleGetServer).Methods("GET")
+	r.HandleFunc("/servers/{server_id}", s.handleSetServer).Methods("PUT")
+	r.HandleFunc("/servers/{server_id}", s.handleRemoveServer).Methods("DELETE")
+	r.HandleFunc("/usage", s.handleUsage).Methods("GET")
+}
+
+func (s *Server) adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get(HEADER_AUTHORIZATION)
+		if !strings.HasPrefix(auth, AUTH_BEARER_PREFIX) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, AUTH_BEARER_PREFIX)), []byte(s.cfg.AdminToken)) != 1 {
+			s.logger.Errorf("%v: unauthorized admin request ip=%v", r.URL.Path, s.getIpAddress(r))
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) wechatDeviceStore(w http.ResponseWriter, r *http.Request) *wechatDeviceStore {
+	pushType := mux.Vars(r)["type"]
+	store, ok := s.wechatDevices[pushType]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no wechat push target for type="+pushType)
+		return nil
+	}
+	return store
+}
+
+func (s *Server) handleListWechatDevices(w http.ResponseWriter, r *http.Request) {
+	store := s.wechatDeviceStore(w, r)
+	if store == nil {
+		return
+	}
+
+	devices, err := store.List()
+	if err != nil {
+		s.logger.Errorf("Failed to list wechat devices err=%v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	bindings := make([]WechatDeviceBinding, 0, len(devices))
+	for deviceID, openID := range devices {
+		bindings = append(bindings, WechatDeviceBinding{DeviceID: deviceID, OpenID: openID})
+	}
+	writeJSON(w, http.StatusOK, bindings)
+}
+
+func (s *Server) handleSetWechatDevice(w http.ResponseWriter, r *http.Request) {
+	store := s.wechatDeviceStore(w, r)
+	if store == nil {
+		return
+	}
+
+	var binding WechatDeviceBinding
+	if err := json.NewDecoder(r.Body).Decode(&binding); err != nil || binding.DeviceID == "" || binding.OpenID == "" {
+		writeJSONError(w, http.StatusBadRequest, "device_id and openid are required")
+		return
+	}
+
+	if err := store.Set(binding.DeviceID, binding.OpenID); err != nil {
+		s.logger.Errorf("Failed to save wechat device did=%v err=%v", binding.DeviceID, err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.logger.Infof("Bound wechat device did=%v type=%v", binding.DeviceID, mux.Vars(r)["type"])
+	writeJSON(w, http.StatusOK, binding)
+}
+
+func (s *Server) handleRemoveWechatDevice(w http.ResponseWriter, r *http.Request) {
+	store := s.wechatDeviceStore(w, r)
+	if store == nil {
+		return
+	}
+
+	deviceID := mux.Vars(r)["device_id"]
+	removed, err := store.Remove(deviceID)
+	if err != nil {
+		s.logger.Errorf("Failed to remove wechat device did=%v err=%v", deviceID, err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !removed {
+		writeJSONError(w, http.StatusNotFound, "no binding for device_id="+deviceID)
+		return
+	}
+	s.logger.Infof("Removed wechat device did=%v type=%v", deviceID, mux.Vars(r)["type"])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListServers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.registry.List())
+}
+
+func (s *Server) handleGetServer(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["server_id"]
+	server, ok := s.registry.Get(serverID)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no server for server_id="+serverID)
+		return
+	}
+	writeJSON(w, http.StatusOK, server)
+}
+
+func (s *Server) handleSetServer(w http.ResponseWriter, r *http.Request) {
+	var server RegisteredServer
+	if err := json.NewDecoder(r.Body).Decode(&server); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid server body")
+		return
+	}
+	server.ServerID = mux.Vars(r)["server_id"]
+	if server.Status == "" {
+		server.Status = ServerStatusAllowed
+	}
+
+	if err := server.isValid(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.registry.Set(&server); err != nil {
+		s.logger.Errorf("Failed to save server serverId=%v err=%v", server.ServerID, err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.logger.Infof("Registered server serverId=%v status=%v", server.ServerID, server.Status)
+	saved, _ := s.registry.Get(server.ServerID)
+	writeJSON(w, http.StatusOK, saved)
+}
+
+func (s *Server) handleRemoveServer(w http.ResponseWriter, r *http.Request) {
+	serverID := mux.Vars(r)["server_id"]
+	removed, err := s.registry.Remove(serverID)
+	if err != nil {
+		s.logger.Errorf("Failed to remove server serverId=%v err=%v", serverID, err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !removed {
+		writeJSONError(w, http.StatusNotFound, "no server for server_id="+serverID)
+		return
+	}
+	s.logger.Infof("Removed server serverId=%v", serverID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	resp := NewErrorPushResponse(message)
+	writeJSON(w, status, resp)
+}
@@ -4,23 +4,39 @@
 package server
 
 import (
+	"context"
+	"net/http"
 	"time"
 
 	fcm "github.com/appleboy/go-fcm"
 	"github.com/kyokomi/emoji"
 )
 
+const (
+	AndroidProviderFCM    = "fcm"
+	AndroidProviderJPush  = "jpush"
+	AndroidProviderWechat = "wechat"
+
+	// fcmMaxRegistrationIDs is the most devices a legacy FCM request may
+	// address.
+	fcmMaxRegistrationIDs = 1000
+)
+
 type AndroidNotificationServer struct {
 	AndroidPushSettings AndroidPushSettings
 	metrics             *metrics
 	logger              *Logger
+	client              *http.Client
 }
 
 func NewAndroidNotificationServer(settings AndroidPushSettings, logger *Logger, metrics *metrics) NotificationServer {
+	client := newHTTPClient(settings.Delivery)
+	client.Transport = &retryAfterTransport{base: client.Transport}
 	return &AndroidNotificationServer{
 		AndroidPushSettings: settings,
 		metrics:             metrics,
 		logger:              logger,
+		client:              client,
 	}
 }
 
@@ -35,7 +51,28 @@ func (me *AndroidNotificationServer) Initialize() bool {
 	return true
 }
 
-func (me *AndroidNotificationServer) SendNotification(msg *PushNotification) PushResponse {
+func (me *AndroidNotificationServer) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
+	return me.send(ctx, []*PushNotification{msg})[0]
+}
+
+// sendMulticast sends msgs, which only differ by their DeviceID, with one
+// request per fcmMaxRegistrationIDs devices.
+func (me *AndroidNotificationServer) sendMulticast(ctx context.Context, msgs []*PushNotification) []PushResponse {
+	resps := make([]PushResponse, 0, len(msgs))
+	for start := 0; start < len(msgs); start += fcmMaxRegistrationIDs {
+		end := start + fcmMaxRegistrationIDs
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		resps = append(resps, me.send(ctx, msgs[start:end])...)
+	}
+	return resps
+}
+
+// send sends the notification of msgs[0] to the devices of msgs in a single
+// request and returns the response of every device.
+func (me *AndroidNotificationServer) send(ctx context.Context, msgs []*PushNotification) []PushResponse {
+	msg := msgs[0]
 	pushType := msg.Type
 	data := map[string]interface{}{
 		"ack_id":     msg.AckID,
@@ -64,65 +101,112 @@ func (me *AndroidNotificationServer) SendNotification(msg *PushNotification) Pus
 		data["from_webhook"] = msg.FromWebhook
 	}
 
+	resps := make([]PushResponse, len(msgs))
 	if me.metrics != nil {
-		me.metrics.incrementNotificationTotal(PushNotifyAndroid, pushType)
+		for range msgs {
+			me.metrics.incrementNotificationTotal(PushNotifyAndroid, pushType)
+		}
 	}
 	fcmMsg := &fcm.Message{
-		To:       msg.DeviceID,
 		Data:     data,
 		Priority: "high",
 	}
+	if len(msgs) == 1 {
+		fcmMsg.To = msg.DeviceID
+	} else {
+		for _, m := range msgs {
+			fcmMsg.RegistrationIDs = append(fcmMsg.RegistrationIDs, m.DeviceID)
+		}
+	}
 
 	if me.AndroidPushSettings.AndroidAPIKey != "" {
-		sender, err := fcm.NewClient(me.AndroidPushSettings.AndroidAPIKey)
+		sender, err := fcm.NewClient(me.AndroidPushSettings.AndroidAPIKey, fcm.WithHTTPClient(me.client))
 		if err != nil {
-			if me.metrics != nil {
-				me.metrics.incrementFailure(PushNotifyAndroid, pushType, "invalid ApiKey")
+			for i := range msgs {
+				if me.metrics != nil {
+					me.metrics.incrementFailure(PushNotifyAndroid, pushType, "invalid ApiKey")
+				}
+				resps[i] = NewErrorPushResponse(err.Error())
 			}
-			return NewErrorPushResponse(err.Error())
+			return resps
 		}
 
-		me.logger.Infof("Sending android push notification for device=%v and type=%v", me.AndroidPushSettings.Type, msg.Type)
+		me.logger.Infof("Sending android push notification for device=%v and type=%v devices=%v", me.AndroidPushSettings.Type, msg.Type, len(msgs))
 
 		start := time.Now()
-		resp, err := sender.SendWithRetry(fcmMsg, 2)
+		ctx, result := withRetryAfterHolder(ctx)
+		resp, err := sender.SendWithContext(ctx, fcmMsg)
 		if me.metrics != nil {
 			me.metrics.observerNotificationResponse(PushNotifyAndroid, time.Since(start).Seconds())
 		}
 
 		if err != nil {
-			me.logger.Errorf("Failed to send FCM push sid=%v did=%v err=%v type=%v", msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
-			if me.metrics != nil {
-				me.metrics.incrementFailure(PushNotifyAndroid, pushType, "unknown transport error")
+			me.logger.Errorf("Failed to send FCM push sid=%v did=%v devices=%v err=%v type=%v", msg.ServerID, msg.DeviceID, len(msgs), err, me.AndroidPushSettings.Type)
+			// go-fcm flattens the errors, the transport tells what happened.
+			statusCode, transportErr := result.result()
+			transient := isTransientTransportError(transportErr) || statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+			for i := range msgs {
+				if me.metrics != nil {
+					me.metrics.incrementFailure(PushNotifyAndroid, pushType, "unknown transport error")
+				}
+				if transient {
+					resps[i] = NewTransientErrorPushResponse("unknown transport error", result.get())
+				} else {
+					resps[i] = NewErrorPushResponse("unknown transport error")
+				}
 			}
-			return NewErrorPushResponse("unknown transport error")
+			return resps
 		}
 
-		if resp.Failure > 0 {
-			fcmError := resp.Results[0].Error
-
-			if fcmError == fcm.ErrInvalidRegistration || fcmError == fcm.ErrNotRegistered || fcmError == fcm.ErrMissingRegistration {
-				me.logger.Infof("Android response failure sending remove code: %v type=%v", resp, me.AndroidPushSettings.Type)
-				if me.metrics != nil {
-					me.metrics.incrementRemoval(PushNotifyAndroid, pushType, fcmError.Error())
+		for i, m := range msgs {
+			var fcmError error
+			if resp.Failure > 0 {
+				if i < len(resp.Results) {
+					fcmError = resp.Results[i].Error
+				} else {
+					fcmError = fcm.ErrUnavailable
 				}
-				return NewRemovePushResponse()
 			}
+			resps[i] = me.resultResponse(m, resp, fcmError)
+		}
+		return resps
+	}
+
+	for i, m := range msgs {
+		resps[i] = me.resultResponse(m, nil, nil)
+	}
+	return resps
+}
 
-			me.logger.Errorf("Android response failure: %v type=%v", resp, me.AndroidPushSettings.Type)
-			if me.metrics != nil {
-				me.metrics.incrementFailure(PushNotifyAndroid, pushType, fcmError.Error())
+// resultResponse turns the FCM result of the device of msg into a push
+// response.
+func (me *AndroidNotificationServer) resultResponse(msg *PushNotification, resp *fcm.Response, fcmError error) PushResponse {
+	pushType := msg.Type
+	if fcmError == nil {
+		if me.metrics != nil {
+			if msg.AckID != "" {
+				me.metrics.incrementSuccessWithAck(PushNotifyAndroid, pushType)
+			} else {
+				me.metrics.incrementSuccess(PushNotifyAndroid, pushType)
 			}
-			return NewErrorPushResponse(fcmError.Error())
 		}
+		return NewOkPushResponse()
 	}
 
-	if me.metrics != nil {
-		if msg.AckID != "" {
-			me.metrics.incrementSuccessWithAck(PushNotifyAndroid, pushType)
-		} else {
-			me.metrics.incrementSuccess(PushNotifyAndroid, pushType)
+	if fcmError == fcm.ErrInvalidRegistration || fcmError == fcm.ErrNotRegistered || fcmError == fcm.ErrMissingRegistration {
+		me.logger.Infof("Android response failure sending remove code: %v did=%v type=%v", resp, msg.DeviceID, me.AndroidPushSettings.Type)
+		if me.metrics != nil {
+			me.metrics.incrementRemoval(PushNotifyAndroid, pushType, fcmError.Error())
 		}
+		return NewRemovePushResponse()
+	}
+
+	me.logger.Errorf("Android response failure: %v did=%v type=%v", resp, msg.DeviceID, me.AndroidPushSettings.Type)
+	if me.metrics != nil {
+		me.metrics.incrementFailure(PushNotifyAndroid, pushType, fcmError.Error())
+	}
+	if fcmError == fcm.ErrUnavailable || fcmError == fcm.ErrInternalServerError {
+		return NewTransientErrorPushResponse(fcmError.Error(), 0)
 	}
-	return NewOkPushResponse()
+	return NewErrorPushResponse(fcmError.Error())
 }
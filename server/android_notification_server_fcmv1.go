@@ -0,0 +1,399 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/kyokomi/emoji"
+)
+
+const (
+	AndroidProviderFCMv1 = "fcmv1"
+
+	fcmV1Scope           = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmV1SendURL         = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	fcmV1DefaultTokenURL = "https://oauth2.googleapis.com/token"
+	fcmV1GrantType       = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	fcmV1ErrorType       = "type.googleapis.com/google.firebase.fcm.v1.FcmError"
+
+	// Access tokens are refreshed this long before Google says they expire.
+	fcmV1TokenExpiryMargin = time.Minute
+
+	FCMv1ErrorUnregistered     = "UNREGISTERED"
+	FCMv1ErrorSenderIDMismatch = "SENDER_ID_MISMATCH"
+	FCMv1ErrorInvalidArgument  = "INVALID_ARGUMENT"
+	FCMv1ErrorQuotaExceeded    = "QUOTA_EXCEEDED"
+	FCMv1ErrorUnavailable      = "UNAVAILABLE"
+	FCMv1ErrorInternal         = "INTERNAL"
+	FCMv1ErrorUnauthenticated  = "UNAUTHENTICATED"
+)
+
+// AndroidNotificationServerV1 sends notifications through the FCM HTTP v1 API,
+// authenticating with a Google service account.
+type AndroidNotificationServerV1 struct {
+	AndroidPushSettings AndroidPushSettings
+	metrics             *metrics
+	logger              *Logger
+	client              *http.Client
+	tokens              *fcmV1TokenSource
+	sendURL             string
+}
+
+type serviceAccount struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+type FCMv1Message struct {
+	Token   string                `json:"token"`
+	Data    map[string]string     `json:"data,omitempty"`
+	Android *FCMv1AndroidSettings `json:"android,omitempty"`
+}
+
+type FCMv1AndroidSettings struct {
+	Priority string `json:"priority,omitempty"`
+}
+
+type FCMv1Request struct {
+	Message *FCMv1Message `json:"message"`
+}
+
+type FCMv1ErrorDetail struct {
+	Type      string `json:"@type"`
+	ErrorCode string `json:"errorCode"`
+}
+
+type FCMv1Error struct {
+	Code    int                `json:"code"`
+	Message string             `json:"message"`
+	Status  string             `json:"status"`
+	Details []FCMv1ErrorDetail `json:"details"`
+}
+
+type FCMv1Response struct {
+	Name  string      `json:"name"`
+	Error *FCMv1Error `json:"error"`
+}
+
+// errorCode returns the FCM specific error code when there is one, falling
+// back to the canonical status otherwise.
+func (e *FCMv1Error) errorCode() string {
+	for _, detail := range e.Details {
+		if detail.Type == fcmV1ErrorType && detail.ErrorCode != "" {
+			return detail.ErrorCode
+		}
+	}
+	return e.Status
+}
+
+func NewAndroidNotificationServerV1(settings AndroidPushSettings, logger *Logger, metrics *metrics) NotificationServer {
+	return &AndroidNotificationServerV1{
+		AndroidPushSettings: settings,
+		metrics:             metrics,
+		logger:              logger,
+		client:              newHTTPClient(settings.Delivery),
+	}
+}
+
+func (me *AndroidNotificationServerV1) Initialize() bool {
+	me.logger.Infof("Initializing Android FCM v1 notification server for type=%v", me.AndroidPushSettings.Type)
+
+	if me.AndroidPushSettings.AndroidServiceAccountFile == "" {
+		me.logger.Error("Android push notifications not configured.  Missing AndroidServiceAccountFile.")
+		return false
+	}
+
+	account, key, err := loadServiceAccount(me.AndroidPushSettings.AndroidServiceAccountFile)
+	if err != nil {
+		me.logger.Errorf("Failed to load the service account file err=%v for type=%v", err, me.AndroidPushSettings.Type)
+		return false
+	}
+
+	me.tokens = &fcmV1TokenSource{account: account, key: key, client: me.client}
+	me.sendURL = me.AndroidPushSettings.AndroidFCMSendURL
+	if me.sendURL == "" {
+		me.sendURL = fmt.Sprintf(fcmV1SendURL, account.ProjectID)
+	}
+
+	return true
+}
+
+func (me *AndroidNotificationServerV1) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
+	pushType := msg.Type
+	data := map[string]string{
+		"ack_id":     msg.AckID,
+		"type":       pushType,
+		"badge":      fmt.Sprint(msg.Badge),
+		"version":    msg.Version,
+		"channel_id": msg.ChannelID,
+	}
+
+	if msg.IsIDLoaded {
+		data["post_id"] = msg.PostID
+		data["message"] = msg.Message
+		data["id_loaded"] = "true"
+		data["sender_id"] = msg.SenderID
+		data["sender_name"] = "Someone"
+	} else if pushType == PushTypeMessage || pushType == PushTypeSession {
+		data["team_id"] = msg.TeamID
+		data["sender_id"] = msg.SenderID
+		data["sender_name"] = msg.SenderName
+		data["message"] = emoji.Sprint(msg.Message)
+		data["channel_name"] = msg.ChannelName
+		data["post_id"] = msg.PostID
+		data["root_id"] = msg.RootID
+		data["override_username"] = msg.OverrideUsername
+		data["override_icon_url"] = msg.OverrideIconURL
+		data["from_webhook"] = msg.FromWebhook
+	}
+
+	if me.metrics != nil {
+		me.metrics.incrementNotificationTotal(PushNotifyAndroid, pushType)
+	}
+
+	if me.tokens == nil {
+		return NewErrorPushResponse("android push notifications not configured")
+	}
+
+	body, err := json.Marshal(&FCMv1Request{
+		Message: &FCMv1Message{
+			Token:   msg.DeviceID,
+			Data:    data,
+			Android: &FCMv1AndroidSettings{Priority: "high"},
+		},
+	})
+	if err != nil {
+		return NewErrorPushResponse(err.Error())
+	}
+
+	token, err := me.tokens.Token(ctx)
+	if err != nil {
+		me.logger.Errorf("Failed to get FCM access token sid=%v did=%v err=%v type=%v", msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PushNotifyAndroid, pushType, "access token error")
+		}
+		if isTransientError(err) {
+			return NewTransientErrorPushResponse("access token error", 0)
+		}
+		return NewErrorPushResponse("access token error")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", me.sendURL, bytes.NewReader(body))
+	if err != nil {
+		return NewErrorPushResponse(err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	me.logger.Infof("Sending android push notification for device=%v and type=%v", me.AndroidPushSettings.Type, msg.Type)
+
+	start := time.Now()
+	resp, err := me.client.Do(req)
+	if me.metrics != nil {
+		me.metrics.observerNotificationResponse(PushNotifyAndroid, time.Since(start).Seconds())
+	}
+	if err != nil {
+		me.logger.Errorf("Failed to send FCM v1 push sid=%v did=%v err=%v type=%v", msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PushNotifyAndroid, pushType, "unknown transport error")
+		}
+		if isTransientTransportError(err) {
+			return NewTransientErrorPushResponse("unknown transport error", 0)
+		}
+		return NewErrorPushResponse("unknown transport error")
+	}
+	defer resp.Body.Close()
+	retryAfter := parseRetryAfter(resp.Header.Get(HEADER_RETRY_AFTER))
+
+	var response FCMv1Response
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(respBody, &response)
+	}
+	if err != nil {
+		me.logger.Errorf("Failed to read FCM v1 response code=%v sid=%v did=%v err=%v type=%v", resp.StatusCode, msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PushNotifyAndroid, pushType, "invalid response")
+		}
+		if isFCMv1TransientError(resp.StatusCode, "") {
+			return NewTransientErrorPushResponse("invalid response", retryAfter)
+		}
+		return NewErrorPushResponse("invalid response")
+	}
+
+	if resp.StatusCode != http.StatusOK || response.Error != nil {
+		reason := http.StatusText(resp.StatusCode)
+		if response.Error != nil {
+			reason = response.Error.errorCode()
+		}
+
+		// INVALID_ARGUMENT is also returned for bad payloads, so it does not
+		// tell that the token is gone.
+		switch reason {
+		case FCMv1ErrorUnregistered, FCMv1ErrorSenderIDMismatch:
+			me.logger.Infof("Android response failure sending remove code: %v type=%v", reason, me.AndroidPushSettings.Type)
+			if me.metrics != nil {
+				me.metrics.incrementRemoval(PushNotifyAndroid, pushType, reason)
+			}
+			return NewRemovePushResponse()
+		case FCMv1ErrorUnauthenticated:
+			// The cached access token was rejected, mint a new one next time.
+			me.tokens.invalidate()
+		}
+
+		me.logger.Errorf("Android response failure: code=%v reason=%v type=%v", resp.StatusCode, reason, me.AndroidPushSettings.Type)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PushNotifyAndroid, pushType, reason)
+		}
+		if isFCMv1TransientError(resp.StatusCode, reason) {
+			return NewTransientErrorPushResponse(reason, retryAfter)
+		}
+		return NewErrorPushResponse(reason)
+	}
+
+	if me.metrics != nil {
+		if msg.AckID != "" {
+			me.metrics.incrementSuccessWithAck(PushNotifyAndroid, pushType)
+		} else {
+			me.metrics.incrementSuccess(PushNotifyAndroid, pushType)
+		}
+	}
+	return NewOkPushResponse()
+}
+
+// isFCMv1TransientError tells whether FCM may accept the message when it is
+// sent again later. UNAUTHENTICATED is retried with a freshly minted token.
+func isFCMv1TransientError(statusCode int, reason string) bool {
+	switch reason {
+	case FCMv1ErrorQuotaExceeded, FCMv1ErrorUnavailable, FCMv1ErrorInternal, FCMv1ErrorUnauthenticated:
+		return true
+	}
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+func loadServiceAccount(fileName string) (*serviceAccount, *rsa.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var account serviceAccount
+	if err = json.Unmarshal(buf, &account); err != nil {
+		return nil, nil, err
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" || account.ProjectID == "" {
+		return nil, nil, errors.New("service account is missing client_email, private_key or project_id")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = fcmV1DefaultTokenURL
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &account, key, nil
+}
+
+// fcmV1TokenSource mints OAuth2 access tokens from a signed JWT assertion and
+// caches them until shortly before they expire.
+type fcmV1TokenSource struct {
+	account *serviceAccount
+	key     *rsa.PrivateKey
+	client  *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type fcmV1TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	TokenType        string `json:"token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (ts *fcmV1TokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Now().Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	now := time.Now()
+	assertion := &jwt.Token{
+		Header: map[string]interface{}{
+			"alg": jwt.SigningMethodRS256.Alg(),
+			"typ": "JWT",
+			"kid": ts.account.PrivateKeyID,
+		},
+		Claims: jwt.MapClaims{
+			"iss":   ts.account.ClientEmail,
+			"scope": fcmV1Scope,
+			"aud":   ts.account.TokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		},
+		Method: jwt.SigningMethodRS256,
+	}
+	signed, err := assertion.SignedString(ts.key)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", fcmV1GrantType)
+	form.Set("assertion", signed)
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var response fcmV1TokenResponse
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	// Error pages of a failing endpoint are not JSON, the status tells.
+	_ = json.Unmarshal(respBody, &response)
+	if resp.StatusCode != http.StatusOK || response.AccessToken == "" {
+		return "", newStatusEndpointError(resp.StatusCode, fmt.Sprintf("token endpoint returned code=%v error=%v %v", resp.StatusCode, response.Error, response.ErrorDescription))
+	}
+
+	ts.token = response.AccessToken
+	ts.expiry = now.Add(time.Duration(response.ExpiresIn)*time.Second - fcmV1TokenExpiryMargin)
+	return ts.token, nil
+}
+
+func (ts *fcmV1TokenSource) invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.token = ""
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAndroidNotificationServerV1(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var tokenRequests, tokenCode int32
+	sendErrors := map[string]string{
+		"unregistered": `{"error":{"code":404,"status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`,
+		"invalid":      `{"error":{"code":400,"status":"INVALID_ARGUMENT"}}`,
+		"mismatch":     `{"error":{"code":403,"status":"PERMISSION_DENIED","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"SENDER_ID_MISMATCH"}]}}`,
+		"quota":        `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"QUOTA_EXCEEDED"}]}}`,
+		"unavailable":  `{"error":{"code":503,"status":"UNAVAILABLE"}}`,
+	}
+	sendCodes := map[string]int{"unregistered": 404, "invalid": 400, "mismatch": 403, "quota": 429, "unavailable": 503}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenRequests, 1)
+		if code := atomic.LoadInt32(&tokenCode); code != 0 {
+			w.WriteHeader(int(code))
+			_, _ = w.Write([]byte(`<html>error</html>`))
+			return
+		}
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, fcmV1GrantType, r.Form.Get("grant_type"))
+
+		assertion, err := jwt.Parse(r.Form.Get("assertion"), func(*jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		require.NoError(t, err)
+		claims := assertion.Claims.(jwt.MapClaims)
+		assert.Equal(t, "proxy@test.iam.gserviceaccount.com", claims["iss"])
+		assert.Equal(t, fcmV1Scope, claims["scope"])
+
+		_, _ = w.Write([]byte(`{"access_token":"access","expires_in":3600,"token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer access", r.Header.Get("Authorization"))
+
+		var req FCMv1Request
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if body, ok := sendErrors[req.Message.Token]; ok {
+			w.WriteHeader(sendCodes[req.Message.Token])
+			_, _ = w.Write([]byte(body))
+			return
+		}
+		assert.Equal(t, "high", req.Message.Android.Priority)
+		assert.Equal(t, "3", req.Message.Data["badge"])
+		_, _ = w.Write([]byte(`{"name":"projects/test/messages/1"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	account, err := json.Marshal(&serviceAccount{
+		Type:        "service_account",
+		ProjectID:   "test",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		ClientEmail: "proxy@test.iam.gserviceaccount.com",
+		TokenURI:    ts.URL + "/token",
+	})
+	require.NoError(t, err)
+	f, err := ioutil.TempFile("", "service-account")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(account)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	logger := NewLogger(&ConfigPushProxy{EnableConsoleLog: true})
+	srv := NewAndroidNotificationServerV1(AndroidPushSettings{
+		Type:                      "android",
+		AndroidServiceAccountFile: f.Name(),
+		AndroidFCMSendURL:         ts.URL + "/send",
+	}, logger, nil)
+	require.True(t, srv.Initialize())
+
+	for deviceID, status := range map[string]string{
+		"device":       PUSH_STATUS_OK,
+		"unregistered": PUSH_STATUS_REMOVE,
+		"invalid":      PUSH_STATUS_FAIL,
+		"mismatch":     PUSH_STATUS_REMOVE,
+		"quota":        PUSH_STATUS_FAIL,
+		"unavailable":  PUSH_STATUS_FAIL,
+	} {
+		resp := srv.SendNotification(context.Background(), &PushNotification{DeviceID: deviceID, Type: PushTypeMessage, Badge: 3})
+		assert.Equal(t, status, resp[PUSH_STATUS], deviceID)
+	}
+
+	assert.Equal(t, "QUOTA_EXCEEDED", srv.SendNotification(context.Background(), &PushNotification{DeviceID: "quota"})[PUSH_STATUS_ERROR_MSG])
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tokenRequests), "access token should be cached")
+
+	// Only 5xx and 429 from the token endpoint are worth retrying.
+	for code, retryable := range map[int]bool{http.StatusBadRequest: false, http.StatusUnauthorized: false, http.StatusServiceUnavailable: true, http.StatusTooManyRequests: true} {
+		atomic.StoreInt32(&tokenCode, int32(code))
+		srv.(*AndroidNotificationServerV1).tokens.invalidate()
+		resp := srv.SendNotification(context.Background(), &PushNotification{DeviceID: "device"})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS], code)
+		assert.Equal(t, retryable, resp.retryable(), code)
+	}
+}
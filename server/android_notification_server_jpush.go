@@ -4,26 +4,53 @@
 package server
 
 import (
-	"time"
-	"strings"
+	"bytes"
+	"context"
 	"encoding/json"
-	"github.com/ylywyn/jpush-api-go-client"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/kyokomi/emoji"
+	jpushclient "github.com/ylywyn/jpush-api-go-client"
+)
+
+const (
+	// JPush error code telling no device matches the audience, meaning the
+	// registration ID is unknown or no longer valid.
+	JPushErrNoAudience = 1011
 )
 
 type AndroidNotificationServerJ struct {
 	AndroidPushSettings AndroidPushSettings
 	metrics             *metrics
 	logger              *Logger
+	apiURL              string
+	client              *http.Client
+	appKey              string
+	masterSecret        string
+	platform            jpushclient.Platform
 }
 
 type JPushError struct {
-	code      string
-	message   string
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JPushID decodes identifiers JPush sends either as strings or numbers.
+type JPushID string
+
+func (id *JPushID) UnmarshalJSON(data []byte) error {
+	*id = JPushID(strings.Trim(string(data), `"`))
+	return nil
 }
 
 type JPushResponse struct {
-    err     *JPushError
+	SendNo JPushID     `json:"sendno"`
+	MsgID  JPushID     `json:"msg_id"`
+	Error  *JPushError `json:"error"`
 }
 
 func NewAndroidNotificationServerJ(settings AndroidPushSettings, logger *Logger, metrics *metrics) NotificationServer {
@@ -31,6 +58,8 @@ func NewAndroidNotificationServerJ(settings AndroidPushSettings, logger *Logger,
 		AndroidPushSettings: settings,
 		metrics:             metrics,
 		logger:              logger,
+		apiURL:              jpushclient.HOST_NAME_SSL,
+		client:              newHTTPClient(settings.Delivery),
 	}
 }
 
@@ -42,10 +71,38 @@ func (me *AndroidNotificationServerJ) Initialize() bool {
 		return false
 	}
 
+	keySec := strings.SplitN(me.AndroidPushSettings.AndroidAPIKey, ":", 2)
+	if len(keySec) != 2 || keySec[0] == "" || keySec[1] == "" {
+		me.logger.Errorf("Android push notifications not configured.  AndroidAPIKey must be formatted as appkey:mastersecret. type=%v", me.AndroidPushSettings.Type)
+		return false
+	}
+	me.appKey = keySec[0]
+	me.masterSecret = keySec[1]
+
+	platforms := me.AndroidPushSettings.JPush.Platforms
+	if len(platforms) == 0 {
+		platforms = []string{jpushclient.ANDROID}
+	}
+	me.platform = jpushclient.Platform{}
+	for _, platform := range platforms {
+		if platform != jpushclient.ANDROID && platform != jpushclient.IOS {
+			me.logger.Errorf("Android push notifications not configured.  Unsupported JPush platform=%v type=%v", platform, me.AndroidPushSettings.Type)
+			return false
+		}
+		_ = me.platform.Add(platform)
+	}
+
+	switch me.AndroidPushSettings.JPush.Audience {
+	case "", jpushclient.ID, jpushclient.ALIAS, jpushclient.TAG:
+	default:
+		me.logger.Errorf("Android push notifications not configured.  Unsupported JPush audience=%v type=%v", me.AndroidPushSettings.JPush.Audience, me.AndroidPushSettings.Type)
+		return false
+	}
+
 	return true
 }
 
-func (me *AndroidNotificationServerJ) SendNotification(msg *PushNotification) PushResponse {
+func (me *AndroidNotificationServerJ) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
 	pushType := msg.Type
 	data := map[string]interface{}{
 		"ack_id":     msg.AckID,
@@ -78,28 +135,48 @@ func (me *AndroidNotificationServerJ) SendNotification(msg *PushNotification) Pu
 		me.metrics.incrementNotificationTotal(PushNotifyAndroid, pushType)
 	}
 
-	var pf jpushclient.Platform
-	pf.Add(jpushclient.ANDROID)
 	var ad jpushclient.Audience
-	s := []string{msg.DeviceID}
-	ad.SetID(s)
+	switch me.AndroidPushSettings.JPush.Audience {
+	case jpushclient.ALIAS:
+		ad.SetAlias([]string{msg.DeviceID})
+	case jpushclient.TAG:
+		ad.SetTag([]string{msg.DeviceID})
+	default:
+		ad.SetID([]string{msg.DeviceID})
+	}
+
+	alert := emoji.Sprint(msg.Message)
+	if alert == "" {
+		alert = "New Message"
+	}
 	var notice jpushclient.Notice
-	notice.SetAlert("New Message")
-	notice.SetAndroidNotice(&jpushclient.AndroidNotice{Alert: msg.Message, Title: msg.SenderName, Extras: make(map[string]interface{})})
-	notice.Android.Extras["data"] = data
+	notice.SetAlert(alert)
+	if me.hasPlatform(jpushclient.IOS) {
+		notice.SetIOSNotice(me.iosNotice(msg, data))
+	}
+	if notice.IOS == nil || me.hasPlatform(jpushclient.ANDROID) {
+		notice.SetAndroidNotice(&jpushclient.AndroidNotice{Alert: msg.Message, Title: msg.SenderName, Extras: map[string]interface{}{"data": data}})
+	}
+
 	payload := jpushclient.NewPushPayLoad()
-	payload.SetPlatform(&pf)
+	payload.SetPlatform(&me.platform)
 	payload.SetAudience(&ad)
-        payload.SetNotice(&notice)
-	bytes, _ := payload.ToBytes()
-	if me.AndroidPushSettings.AndroidAPIKey != "" {
-		keySec := strings.Split(me.AndroidPushSettings.AndroidAPIKey, ":")
-		sender := jpushclient.NewPushClient(keySec[1], keySec[0])
+	payload.SetNotice(&notice)
+	payload.SetOptions(&jpushclient.Option{
+		TimeLive:       me.AndroidPushSettings.JPush.TimeToLive,
+		ApnsProduction: me.AndroidPushSettings.JPush.ApnsProduction,
+		OverrideMsgId:  me.AndroidPushSettings.JPush.OverrideMsgID,
+	})
+	body, err := payload.ToBytes()
+	if err != nil {
+		return NewErrorPushResponse(err.Error())
+	}
 
+	if me.appKey != "" {
 		me.logger.Infof("Sending android push notification for device=%v and type=%v", me.AndroidPushSettings.Type, msg.Type)
 
 		start := time.Now()
-		resp, err := sender.Send(bytes)
+		statusCode, response, err := me.send(ctx, body)
 		if me.metrics != nil {
 			me.metrics.observerNotificationResponse(PushNotifyAndroid, time.Since(start).Seconds())
 		}
@@ -109,27 +186,51 @@ func (me *AndroidNotificationServerJ) SendNotification(msg *PushNotification) Pu
 			if me.metrics != nil {
 				me.metrics.incrementFailure(PushNotifyAndroid, pushType, "unknown transport error")
 			}
+			if isTransientTransportError(err) {
+				return NewTransientErrorPushResponse("unknown transport error", 0)
+			}
 			return NewErrorPushResponse("unknown transport error")
 		}
 
-		var response JPushResponse
-		err = json.Unmarshal([]byte(resp), &response)
-		if err != nil {
-			me.logger.Errorf("Failed to unmarshal response: %v sid=%v did=%v err=%v type=%v", resp, msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
+		if response == nil {
+			me.logger.Errorf("Failed to decode J push response code=%v sid=%v did=%v type=%v", statusCode, msg.ServerID, msg.DeviceID, me.AndroidPushSettings.Type)
 			if me.metrics != nil {
 				me.metrics.incrementFailure(PushNotifyAndroid, pushType, "invalid response")
 			}
+			if isJPushTransientError(statusCode) {
+				return NewTransientErrorPushResponse("invalid response", 0)
+			}
 			return NewErrorPushResponse("invalid response")
 		}
 
-		if response.err != nil {
-			me.logger.Errorf("Failed to send J push sid=%v did=%v err=%v type=%v", msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
+		if response.Error != nil {
+			reason := strconv.Itoa(response.Error.Code)
+			if response.Error.Code == JPushErrNoAudience {
+				me.logger.Infof("J push response failure sending remove code: %v message=%v type=%v", response.Error.Code, response.Error.Message, me.AndroidPushSettings.Type)
+				if me.metrics != nil {
+					me.metrics.incrementRemoval(PushNotifyAndroid, pushType, reason)
+				}
+				return NewRemovePushResponse()
+			}
+
+			me.logger.Errorf("Failed to send J push sid=%v did=%v code=%v message=%v type=%v", msg.ServerID, msg.DeviceID, response.Error.Code, response.Error.Message, me.AndroidPushSettings.Type)
+			if me.metrics != nil {
+				me.metrics.incrementFailure(PushNotifyAndroid, pushType, reason)
+			}
+			if isJPushTransientError(statusCode) {
+				return NewTransientErrorPushResponse(response.Error.Message, 0)
+			}
+			return NewErrorPushResponse(response.Error.Message)
+		}
+
+		if response.MsgID == "" {
+			me.logger.Errorf("J push response without msg_id code=%v sid=%v did=%v type=%v", statusCode, msg.ServerID, msg.DeviceID, me.AndroidPushSettings.Type)
 			if me.metrics != nil {
-				me.metrics.incrementFailure(PushNotifyAndroid, pushType, response.err.message)
+				me.metrics.incrementFailure(PushNotifyAndroid, pushType, "invalid response")
 			}
-			return NewErrorPushResponse(response.err.message)
+			return NewErrorPushResponse("invalid response")
 		}
-		me.logger.Errorf("Sent resp=%v", resp)
+		me.logger.Infof("Sent J push msg_id=%v sid=%v type=%v", response.MsgID, msg.ServerID, me.AndroidPushSettings.Type)
 	}
 
 	if me.metrics != nil {
@@ -141,3 +242,71 @@ func (me *AndroidNotificationServerJ) SendNotification(msg *PushNotification) Pu
 	}
 	return NewOkPushResponse()
 }
+
+// isJPushTransientError tells whether JPush may accept the push when it is
+// sent again later, i.e. it was throttled or failed on its side.
+func isJPushTransientError(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+func (me *AndroidNotificationServerJ) hasPlatform(platform string) bool {
+	for _, p := range me.AndroidPushSettings.JPush.Platforms {
+		if p == platform {
+			return true
+		}
+	}
+	return false
+}
+
+func (me *AndroidNotificationServerJ) iosNotice(msg *PushNotification, data map[string]interface{}) *jpushclient.IOSNotice {
+	notice := &jpushclient.IOSNotice{
+		Badge:    strconv.Itoa(msg.Badge),
+		Category: msg.Category,
+		Extras:   data,
+	}
+
+	switch msg.Type {
+	case PushTypeClear, PushTypeUpdateBadge:
+		// Silent pushes, handled by the apps.
+		notice.Alert = ""
+		notice.ContentAvailable = true
+	default:
+		notice.Sound = "default"
+		notice.MutableContent = true
+		if msg.ChannelName != "" && msg.Version == PushMessageV2 {
+			notice.Alert = map[string]string{"title": msg.ChannelName, "body": emoji.Sprint(msg.Message)}
+		} else {
+			notice.Alert = emoji.Sprint(msg.Message)
+		}
+	}
+	return notice
+}
+
+// send posts the payload to JPush. The response is nil when the body could
+// not be decoded.
+func (me *AndroidNotificationServerJ) send(ctx context.Context, body []byte) (int, *JPushResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", me.apiURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.SetBasicAuth(me.appKey, me.masterSecret)
+	req.Header.Set("Content-Type", jpushclient.CONTENT_TYPE_JSON)
+	req.Header.Set("Charset", jpushclient.CHARSET)
+
+	resp, err := me.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+
+	var response JPushResponse
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return resp.StatusCode, nil, nil
+	}
+	return resp.StatusCode, &response, nil
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAndroidNotificationServerJ(t *testing.T) {
+	responses := map[string]struct {
+		code int
+		body string
+	}{
+		"ok":       {http.StatusOK, `{"sendno":"0","msg_id":"54043195528424016"}`},
+		"numeric":  {http.StatusOK, `{"sendno":0,"msg_id":54043195528424016}`},
+		"unknown":  {http.StatusBadRequest, `{"error":{"code":1011,"message":"cannot find user by this audience"}}`},
+		"invalid":  {http.StatusBadRequest, `{"error":{"code":1003,"message":"parameter value is invalid"}}`},
+		"auth":     {http.StatusUnauthorized, `{"error":{"code":1004,"message":"appkey not exist"}}`},
+		"garbage":  {http.StatusBadGateway, `<html>bad gateway</html>`},
+		"no-msgid": {http.StatusOK, `{"sendno":"0"}`},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appKey, secret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "appkey", appKey)
+		assert.Equal(t, "secret", secret)
+
+		var payload struct {
+			Audience struct {
+				RegistrationID []string `json:"registration_id"`
+			} `json:"audience"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		resp := responses[payload.Audience.RegistrationID[0]]
+		w.WriteHeader(resp.code)
+		_, _ = w.Write([]byte(resp.body))
+	}))
+	defer ts.Close()
+
+	srv := NewAndroidNotificationServerJ(AndroidPushSettings{Type: "android_cn", AndroidAPIKey: "junk"}, NewLogger(&ConfigPushProxy{EnableConsoleLog: true}), nil).(*AndroidNotificationServerJ)
+	require.False(t, srv.Initialize())
+
+	srv = NewAndroidNotificationServerJ(AndroidPushSettings{Type: "android_cn", AndroidAPIKey: "appkey:secret"}, NewLogger(&ConfigPushProxy{EnableConsoleLog: true}), nil).(*AndroidNotificationServerJ)
+	srv.apiURL = ts.URL
+	require.True(t, srv.Initialize())
+
+	for deviceID, status := range map[string]string{
+		"ok":       PUSH_STATUS_OK,
+		"numeric":  PUSH_STATUS_OK,
+		"unknown":  PUSH_STATUS_REMOVE,
+		"invalid":  PUSH_STATUS_FAIL,
+		"auth":     PUSH_STATUS_FAIL,
+		"garbage":  PUSH_STATUS_FAIL,
+		"no-msgid": PUSH_STATUS_FAIL,
+	} {
+		resp := srv.SendNotification(context.Background(), &PushNotification{DeviceID: deviceID, Type: PushTypeMessage})
+		assert.Equal(t, status, resp[PUSH_STATUS], deviceID)
+	}
+
+	resp := srv.SendNotification(context.Background(), &PushNotification{DeviceID: "auth", Type: PushTypeMessage})
+	assert.Equal(t, "appkey not exist", resp[PUSH_STATUS_ERROR_MSG])
+}
+
+func TestAndroidNotificationServerJOptions(t *testing.T) {
+	var payload map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		_, _ = w.Write([]byte(`{"sendno":"0","msg_id":"1"}`))
+	}))
+	defer ts.Close()
+
+	logger := NewLogger(&ConfigPushProxy{EnableConsoleLog: true})
+	settings := AndroidPushSettings{Type: "android_cn", AndroidAPIKey: "appkey:secret", JPush: JPushSettings{Platforms: []string{"winphone"}}}
+	require.False(t, NewAndroidNotificationServerJ(settings, logger, nil).Initialize())
+	settings.JPush = JPushSettings{Audience: "junk"}
+	require.False(t, NewAndroidNotificationServerJ(settings, logger, nil).Initialize())
+
+	// Defaults keep android only, registration ids and JPush option defaults.
+	settings.JPush = JPushSettings{}
+	srv := NewAndroidNotificationServerJ(settings, logger, nil).(*AndroidNotificationServerJ)
+	srv.apiURL = ts.URL
+	require.True(t, srv.Initialize())
+	require.Equal(t, PUSH_STATUS_OK, srv.SendNotification(context.Background(), &PushNotification{DeviceID: "regid", Type: PushTypeMessage, Message: "hi"})[PUSH_STATUS])
+	require.Equal(t, []interface{}{"android"}, payload["platform"])
+	require.Equal(t, map[string]interface{}{"registration_id": []interface{}{"regid"}}, payload["audience"])
+	require.Equal(t, map[string]interface{}{"apns_production": false}, payload["options"])
+	notification := payload["notification"].(map[string]interface{})
+	require.Equal(t, "hi", notification["alert"])
+	require.Contains(t, notification, "android")
+	require.NotContains(t, notification, "ios")
+
+	settings.JPush = JPushSettings{
+		Platforms:      []string{"ios"},
+		Audience:       "alias",
+		TimeToLive:     600,
+		ApnsProduction: true,
+		OverrideMsgID:  42,
+	}
+	srv = NewAndroidNotificationServerJ(settings, logger, nil).(*AndroidNotificationServerJ)
+	srv.apiURL = ts.URL
+	require.True(t, srv.Initialize())
+	require.Equal(t, PUSH_STATUS_OK, srv.SendNotification(context.Background(), &PushNotification{DeviceID: "user", Type: PushTypeMessage, Message: "hi", Badge: 2})[PUSH_STATUS])
+	require.Equal(t, []interface{}{"ios"}, payload["platform"])
+	require.Equal(t, map[string]interface{}{"alias": []interface{}{"user"}}, payload["audience"])
+	require.Equal(t, map[string]interface{}{"apns_production": true, "time_to_live": float64(600), "override_msg_id": float64(42)}, payload["options"])
+	notification = payload["notification"].(map[string]interface{})
+	require.NotContains(t, notification, "android")
+	ios := notification["ios"].(map[string]interface{})
+	require.Equal(t, "hi", ios["alert"])
+	require.Equal(t, "2", ios["badge"])
+	require.Equal(t, "default", ios["sound"])
+
+	settings.JPush = JPushSettings{Platforms: []string{"android", "ios"}, Audience: "tag"}
+	srv = NewAndroidNotificationServerJ(settings, logger, nil).(*AndroidNotificationServerJ)
+	srv.apiURL = ts.URL
+	require.True(t, srv.Initialize())
+	require.Equal(t, PUSH_STATUS_OK, srv.SendNotification(context.Background(), &PushNotification{DeviceID: "group", Type: PushTypeClear})[PUSH_STATUS])
+	require.Equal(t, []interface{}{"android", "ios"}, payload["platform"])
+	require.Equal(t, map[string]interface{}{"tag": []interface{}{"group"}}, payload["audience"])
+	notification = payload["notification"].(map[string]interface{})
+	require.Contains(t, notification, "android")
+	require.Equal(t, true, notification["ios"].(map[string]interface{})["content-available"])
+}
+
+func TestAndroidNotificationServerJTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	logger := NewLogger(&ConfigPushProxy{EnableConsoleLog: true})
+	settings := AndroidPushSettings{Type: "android_cn", AndroidAPIKey: "appkey:secret", Delivery: DeliverySettings{RequestTimeoutMs: 50}}
+	srv := NewAndroidNotificationServerJ(settings, logger, nil).(*AndroidNotificationServerJ)
+	srv.apiURL = ts.URL
+	require.True(t, srv.Initialize())
+
+	start := time.Now()
+	resp := srv.SendNotification(context.Background(), &PushNotification{DeviceID: "slow", Type: PushTypeMessage})
+	assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+	assert.True(t, resp.retryable())
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// Cancelling the context aborts the call before the request timeout.
+	settings.Delivery.RequestTimeoutMs = 0
+	srv = NewAndroidNotificationServerJ(settings, logger, nil).(*AndroidNotificationServerJ)
+	srv.apiURL = ts.URL
+	require.True(t, srv.Initialize())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	resp = srv.SendNotification(ctx, &PushNotification{DeviceID: "slow", Type: PushTypeMessage})
+	assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -4,24 +4,23 @@
 package server
 
 import (
-	"os"
-	"time"
-	"strings"
 	"bytes"
-	"io/ioutil"
-	"strconv"
+	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
-	"path/filepath"
+	"time"
 )
 
-var WechatAccessToken string
-var WechatExpiresTime time.Time
-
 type AndroidNotificationServerW struct {
 	AndroidPushSettings AndroidPushSettings
 	metrics             *metrics
 	logger              *Logger
+	apiURL              string
+	client              *http.Client
+	tokens              *wechatTokenManager
+	devices             *wechatDeviceStore
+	template            *wechatTemplate
 }
 
 type KeyWordData struct {
@@ -33,17 +32,13 @@ type TemplateMsg struct {
 	Touser      string                  `json:"touser"`
 	Template_id string                  `json:"template_id"`
 	Url         string                  `json:"url,omitempty"`
+	MiniProgram *TemplateMiniProgram    `json:"miniprogram,omitempty"`
 	Data        map[string]*KeyWordData `json:"data"`
 }
 
 type WPushResponse struct {
-	ErrCode     int    `json:"errcode"`
-	ErrMsg      string `json:"errmsg"`
-}
-
-type TokenResponse struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
 }
 
 func NewAndroidNotificationServerW(settings AndroidPushSettings, logger *Logger, metrics *metrics) NotificationServer {
@@ -51,6 +46,8 @@ func NewAndroidNotificationServerW(settings AndroidPushSettings, logger *Logger,
 		AndroidPushSettings: settings,
 		metrics:             metrics,
 		logger:              logger,
+		apiURL:              wechatAPIURL,
+		client:              newHTTPClient(settings.Delivery),
 	}
 }
 
@@ -62,22 +59,44 @@ func (me *AndroidNotificationServerW) Initialize() bool {
 		return false
 	}
 
+	tokens, err := newWechatTokenManager(me.AndroidPushSettings.AndroidAPIKey, me.apiURL, me.client)
+	if err != nil {
+		me.logger.Errorf("Android push notifications not configured. err=%v type=%v", err, me.AndroidPushSettings.Type)
+		return false
+	}
+	me.tokens = tokens
+
+	deviceMapFile := me.AndroidPushSettings.WechatDeviceMapFile
+	if deviceMapFile == "" {
+		deviceMapFile = FindConfigFile(defaultWechatDeviceMapFile)
+	}
+	devices, err := newWechatDeviceStore(deviceMapFile)
+	if err != nil {
+		me.logger.Errorf("Failed to load the wechat device map file=%v err=%v type=%v", deviceMapFile, err, me.AndroidPushSettings.Type)
+		return false
+	}
+	me.devices = devices
+
+	tmpl, err := newWechatTemplate(me.AndroidPushSettings.WechatTemplate)
+	if err != nil {
+		me.logger.Errorf("Android push notifications not configured. err=%v type=%v", err, me.AndroidPushSettings.Type)
+		return false
+	}
+	me.template = tmpl
+
 	return true
 }
 
-func (me *AndroidNotificationServerW) SendNotification(msg *PushNotification) PushResponse {
+func (me *AndroidNotificationServerW) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
 	pushType := msg.Type
-	var data map[string]string
-	if _, err := os.Stat("./config/wechat-device-ids.json"); err != nil {
+	if me.devices == nil {
 		return NewErrorPushResponse("Map not found error")
 	}
-	fileName, _ := filepath.Abs("./config/wechat-device-ids.json")
-	mapData, _ := ioutil.ReadFile(fileName)
-	err := json.Unmarshal(mapData, &data)
+	deviceId, exists, err := me.devices.Lookup(msg.DeviceID)
 	if err != nil {
+		me.logger.Errorf("Failed to read the wechat device map err=%v type=%v", err, me.AndroidPushSettings.Type)
 		return NewErrorPushResponse("Unmarshal map error")
 	}
-	deviceId, exists := data[msg.DeviceID]
 	if !exists {
 		return NewErrorPushResponse("No map error")
 	}
@@ -86,75 +105,56 @@ func (me *AndroidNotificationServerW) SendNotification(msg *PushNotification) Pu
 		me.metrics.incrementNotificationTotal(PushNotifyAndroid, pushType)
 	}
 
-	dataMsg := make(map[string]*KeyWordData)
-	dataMsg["content"] = &KeyWordData{
-		Value: msg.SenderName + ": " + msg.Message,
-	}
-	message := &TemplateMsg{
-		Touser:      deviceId,
-		Template_id: "3qW96y74I5Wari8oFvmu82fj9yS4LNyfPrmtLadydrI",
-		Data:        dataMsg,
+	message, err := me.template.Message(deviceId, msg)
+	if err != nil {
+		me.logger.Errorf("Failed to render Wechat template sid=%v did=%v err=%v type=%v", msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PushNotifyAndroid, pushType, "invalid template")
+		}
+		return NewErrorPushResponse("invalid template")
 	}
 	body, _ := json.MarshalIndent(message, " ", "  ")
-	if me.AndroidPushSettings.AndroidAPIKey != "" {
-		token, err := GetToken(me.AndroidPushSettings.AndroidAPIKey)
-		me.logger.Errorf("Token=%v", token)
-		if err != nil {
-			me.logger.Errorf("Failed to get Wechat token sid=%v did=%v err=%v type=%v", msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
-			return NewErrorPushResponse("Getting token error")
-		}
-		post_url := "https://api.weixin.qq.com/cgi-bin/message/template/send?access_token=" + token
-		req, _ := http.NewRequest("POST", post_url, bytes.NewReader(body))
-		req.Header.Set("Content-Type", "application/json;encoding=utf-8")
-		client := &http.Client{}
-
+	if me.tokens != nil {
 		me.logger.Infof("Sending android push notification for device=%v and type=%v", me.AndroidPushSettings.Type, msg.Type)
 
 		start := time.Now()
+		response, err := me.sendTemplateMessage(ctx, body)
 		if me.metrics != nil {
 			me.metrics.observerNotificationResponse(PushNotifyAndroid, time.Since(start).Seconds())
 		}
 
-		resp, err := client.Do(req)
 		if err != nil {
-			if resp.Body != nil {
-				resp.Body.Close()
-			}
 			me.logger.Errorf("Failed to send Wechat push sid=%v did=%v err=%v type=%v", msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
 			if me.metrics != nil {
 				me.metrics.incrementFailure(PushNotifyAndroid, pushType, "unknown transport error")
 			}
+			if isTransientError(err) {
+				return NewTransientErrorPushResponse("unknown transport error", 0)
+			}
 			return NewErrorPushResponse("unknown transport error")
 		}
 
-		defer resp.Body.Close()
-		var response WPushResponse
-		respBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			me.logger.Errorf("Failed to read response: %v sid=%v did=%v err=%v type=%v", resp, msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
-			if me.metrics != nil {
-				me.metrics.incrementFailure(PushNotifyAndroid, pushType, "invalid response")
+		if isWechatRemoveError(response.ErrCode) {
+			me.logger.Infof("Wechat response failure sending remove code sid=%v did=%v errcode=%v errmsg=%v type=%v", msg.ServerID, msg.DeviceID, response.ErrCode, response.ErrMsg, me.AndroidPushSettings.Type)
+			if _, err := me.devices.Remove(msg.DeviceID); err != nil {
+				me.logger.Errorf("Failed to remove wechat device did=%v err=%v type=%v", msg.DeviceID, err, me.AndroidPushSettings.Type)
 			}
-			return NewErrorPushResponse("invalid response")
-		}
-
-		err = json.Unmarshal(respBody, &response)
-		if err != nil {
-			me.logger.Errorf("Failed to unmarshal response: %v sid=%v did=%v err=%v type=%v", resp, msg.ServerID, msg.DeviceID, err, me.AndroidPushSettings.Type)
 			if me.metrics != nil {
-				me.metrics.incrementFailure(PushNotifyAndroid, pushType, "invalid response")
+				me.metrics.incrementRemoval(PushNotifyAndroid, pushType, response.ErrMsg)
 			}
-			return NewErrorPushResponse("invalid response")
+			return NewRemovePushResponse()
 		}
 
 		if response.ErrCode != 0 {
-			me.logger.Errorf("Failed to send Wechat push sid=%v did=%v err=%v type=%v", msg.ServerID, msg.DeviceID, response.ErrCode, me.AndroidPushSettings.Type)
+			me.logger.Errorf("Failed to send Wechat push sid=%v did=%v errcode=%v errmsg=%v type=%v", msg.ServerID, msg.DeviceID, response.ErrCode, response.ErrMsg, me.AndroidPushSettings.Type)
 			if me.metrics != nil {
 				me.metrics.incrementFailure(PushNotifyAndroid, pushType, response.ErrMsg)
 			}
+			if response.ErrCode == WechatErrSystemBusy {
+				return NewTransientErrorPushResponse(response.ErrMsg, 0)
+			}
 			return NewErrorPushResponse(response.ErrMsg)
 		}
-		me.logger.Errorf("Sent resp=%v", resp)
 	}
 
 	if me.metrics != nil {
@@ -167,36 +167,62 @@ func (me *AndroidNotificationServerW) SendNotification(msg *PushNotification) Pu
 	return NewOkPushResponse()
 }
 
-
-func GetToken(key string) (string, error) {
-	if time.Now().Before(WechatExpiresTime) {
-		return WechatAccessToken, nil
+// resolveDeviceID tells whether deviceID is bound to an OpenID. The lookup
+// itself is done when sending.
+func (me *AndroidNotificationServerW) resolveDeviceID(deviceID string) (string, bool) {
+	if me.devices == nil {
+		return "", false
 	}
-	idSec := strings.Split(key, ":")
-	url := "https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=" + idSec[0] + "&secret=" + idSec[1]
-	resp, err := http.Get(url)
+	_, exists, err := me.devices.Lookup(deviceID)
 	if err != nil {
-		if resp != nil {
-			resp.Body.Close()
+		me.logger.Errorf("Failed to read the wechat device map err=%v type=%v", err, me.AndroidPushSettings.Type)
+		return "", false
+	}
+	return deviceID, exists
+}
+
+// sendTemplateMessage posts a template message, retrying once with a fresh
+// access token when WeChat reports the cached one as invalid or expired.
+func (me *AndroidNotificationServerW) sendTemplateMessage(ctx context.Context, body []byte) (*WPushResponse, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := me.tokens.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := me.postTemplateMessage(ctx, token, body)
+		if err != nil {
+			return nil, err
 		}
-		return "", err
+		if attempt == 0 && isWechatTokenError(response.ErrCode) {
+			me.logger.Infof("Wechat access token rejected errcode=%v, refreshing type=%v", response.ErrCode, me.AndroidPushSettings.Type)
+			me.tokens.Invalidate(token)
+			continue
+		}
+		return response, nil
 	}
-	if resp == nil {
-		return "", nil
+}
+
+func (me *AndroidNotificationServerW) postTemplateMessage(ctx context.Context, token string, body []byte) (*WPushResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", me.apiURL+"/cgi-bin/message/template/send?access_token="+token, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json;encoding=utf-8")
 
+	resp, err := me.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
+
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	var response TokenResponse
-	err = json.Unmarshal(respBody, &response)
-	if err != nil {
-		return "", err
+	var response WPushResponse
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return nil, newStatusEndpointError(resp.StatusCode, "invalid response")
 	}
-	WechatAccessToken = response.AccessToken
-	s, _ := time.ParseDuration(strconv.Itoa(response.ExpiresIn) + "s")
-	WechatExpiresTime = time.Now().Add(s)
-	return WechatAccessToken, nil
-}
\ No newline at end of file
+	return &response, nil
+}
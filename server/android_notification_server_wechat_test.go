@@ -0,0 +1,78 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAndroidNotificationServerW(t *testing.T) {
+	errCodes := map[string]int{
+		"openid-ok":           0,
+		"openid-unsubscribed": WechatErrUnsubscribed,
+		"openid-invalid":      WechatErrInvalidOpenID,
+		"openid-refused":      WechatErrUserRefused,
+		"openid-busy":         -1,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/token", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"access_token":"token","expires_in":7200}`))
+	})
+	mux.HandleFunc("/cgi-bin/message/template/send", func(w http.ResponseWriter, r *http.Request) {
+		var message TemplateMsg
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&message))
+		fmt.Fprintf(w, `{"errcode":%d,"errmsg":"%s"}`, errCodes[message.Touser], message.Touser)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "wechat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	deviceMapFile := filepath.Join(dir, "devices.json")
+	devices := make(map[string]string)
+	for openID := range errCodes {
+		devices["device-"+openID] = openID
+	}
+	buf, _ := json.Marshal(devices)
+	require.NoError(t, ioutil.WriteFile(deviceMapFile, buf, 0644))
+
+	srv := NewAndroidNotificationServerW(AndroidPushSettings{
+		Type:                "android_cn",
+		AndroidAPIKey:       "appid:secret",
+		WechatDeviceMapFile: deviceMapFile,
+	}, NewLogger(&ConfigPushProxy{EnableConsoleLog: true}), nil).(*AndroidNotificationServerW)
+	srv.apiURL = ts.URL
+	require.True(t, srv.Initialize())
+
+	for openID, status := range map[string]string{
+		"openid-ok":           PUSH_STATUS_OK,
+		"openid-unsubscribed": PUSH_STATUS_REMOVE,
+		"openid-invalid":      PUSH_STATUS_REMOVE,
+		"openid-refused":      PUSH_STATUS_REMOVE,
+		"openid-busy":         PUSH_STATUS_FAIL,
+	} {
+		resp := srv.SendNotification(context.Background(), &PushNotification{DeviceID: "device-" + openID, Type: PushTypeMessage})
+		assert.Equal(t, status, resp[PUSH_STATUS], openID)
+
+		_, bound, err := srv.devices.Lookup("device-" + openID)
+		require.NoError(t, err)
+		assert.Equal(t, status != PUSH_STATUS_REMOVE, bound, openID)
+	}
+
+	resp := srv.SendNotification(context.Background(), &PushNotification{DeviceID: "unknown"})
+	assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+}
@@ -4,7 +4,9 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
@@ -13,6 +15,7 @@ import (
 	apns "github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/certificate"
 	"github.com/sideshow/apns2/payload"
+	"github.com/sideshow/apns2/token"
 	"golang.org/x/net/http2"
 )
 
@@ -34,50 +37,78 @@ func NewAppleNotificationServer(settings ApplePushSettings, logger *Logger, metr
 func (me *AppleNotificationServer) Initialize() bool {
 	me.logger.Infof("Initializing apple notification server for type=%v", me.ApplePushSettings.Type)
 
-	if me.ApplePushSettings.ApplePushCertPrivate != "" {
+	tlsConfig := &tls.Config{}
+	if me.ApplePushSettings.ApplePushAuthKey != "" {
+		if me.ApplePushSettings.ApplePushKeyID == "" || me.ApplePushSettings.ApplePushTeamID == "" {
+			me.logger.Errorf("Apple push notifications not configured.  ApplePushAuthKey requires ApplePushKeyID and ApplePushTeamID. for type=%v", me.ApplePushSettings.Type)
+			return false
+		}
+
+		authKey, err := token.AuthKeyFromFile(me.ApplePushSettings.ApplePushAuthKey)
+		if err != nil {
+			me.logger.Panicf("Failed to load the apple auth key err=%v for type=%v", err, me.ApplePushSettings.Type)
+			return false
+		}
+
+		// The client regenerates the provider token before Apple's one hour limit.
+		me.AppleClient = apns.NewTokenClient(&token.Token{
+			AuthKey: authKey,
+			KeyID:   me.ApplePushSettings.ApplePushKeyID,
+			TeamID:  me.ApplePushSettings.ApplePushTeamID,
+		})
+	} else if me.ApplePushSettings.ApplePushCertPrivate != "" {
 		appleCert, appleCertErr := certificate.FromPemFile(me.ApplePushSettings.ApplePushCertPrivate, me.ApplePushSettings.ApplePushCertPassword)
 		if appleCertErr != nil {
 			me.logger.Panicf("Failed to load the apple pem cert err=%v for type=%v", appleCertErr, me.ApplePushSettings.Type)
 			return false
 		}
 
-		if me.ApplePushSettings.ApplePushUseDevelopment {
-			me.AppleClient = apns.NewClient(appleCert).Development()
-		} else {
-			me.AppleClient = apns.NewClient(appleCert).Production()
-		}
+		me.AppleClient = apns.NewClient(appleCert)
+		tlsConfig.Certificates = []tls.Certificate{appleCert}
+	} else {
+		me.logger.Errorf("Apple push notifications not configured.  Missing ApplePushCertPrivate or ApplePushAuthKey. for type=%v", me.ApplePushSettings.Type)
+		return false
+	}
 
-		// Override the native transport.
-		proxyServer := getProxyServer()
-		if proxyServer != "" {
-			tlsConfig := &tls.Config{
-				Certificates: []tls.Certificate{appleCert},
-			}
+	if me.ApplePushSettings.ApplePushUseDevelopment {
+		me.AppleClient.Development()
+	} else {
+		me.AppleClient.Production()
+	}
 
-			transport := &http.Transport{
-				TLSClientConfig: tlsConfig,
-				Proxy: func(request *http.Request) (*url.URL, error) {
-					return url.Parse(proxyServer)
-				},
-				IdleConnTimeout: apns.HTTPClientTimeout,
-			}
-			err := http2.ConfigureTransport(transport)
-			if err != nil {
-				me.logger.Errorf("Transport Error: %v", err)
-				return false
-			}
+	delivery := me.ApplePushSettings.Delivery
+	me.AppleClient.HTTPClient.Timeout = delivery.requestTimeout()
+	if transport, ok := me.AppleClient.HTTPClient.Transport.(*http2.Transport); ok {
+		transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return tls.DialWithDialer(delivery.dialer(), network, addr, cfg)
+		}
+	}
 
-			me.AppleClient.HTTPClient.Transport = transport
+	// Override the native transport.
+	proxyServer := getProxyServer()
+	if proxyServer != "" {
+		transport := &http.Transport{
+			TLSClientConfig: tlsConfig,
+			Proxy: func(request *http.Request) (*url.URL, error) {
+				return url.Parse(proxyServer)
+			},
+			DialContext:     delivery.dialer().DialContext,
+			IdleConnTimeout: apns.HTTPClientTimeout,
+		}
+		err := http2.ConfigureTransport(transport)
+		if err != nil {
+			me.logger.Errorf("Transport Error: %v", err)
+			return false
 		}
 
-		return true
-	} else {
-		me.logger.Errorf("Apple push notifications not configured.  Missing ApplePushCertPrivate. for type=%v", me.ApplePushSettings.Type)
-		return false
+		me.AppleClient.HTTPClient.Transport = transport
 	}
+	me.AppleClient.HTTPClient.Transport = &retryAfterTransport{base: me.AppleClient.HTTPClient.Transport}
+
+	return true
 }
 
-func (me *AppleNotificationServer) SendNotification(msg *PushNotification) PushResponse {
+func (me *AppleNotificationServer) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
 
 	data := payload.NewPayload()
 	data.Badge(msg.Badge)
@@ -169,7 +200,8 @@ func (me *AppleNotificationServer) SendNotification(msg *PushNotification) PushR
 	if me.AppleClient != nil {
 		me.logger.Infof("Sending apple push notification for device=%v and type=%v", me.ApplePushSettings.Type, msg.Type)
 		start := time.Now()
-		res, err := me.AppleClient.Push(notification)
+		ctx, retryAfter := withRetryAfterHolder(ctx)
+		res, err := me.AppleClient.PushWithContext(ctx, notification)
 		if me.metrics != nil {
 			me.metrics.observerNotificationResponse(PushNotifyApple, time.Since(start).Seconds())
 		}
@@ -178,6 +210,9 @@ func (me *AppleNotificationServer) SendNotification(msg *PushNotification) PushR
 			if me.metrics != nil {
 				me.metrics.incrementFailure(PushNotifyApple, pushType, "RequestError")
 			}
+			if isTransientTransportError(err) {
+				return NewTransientErrorPushResponse("unknown transport error", 0)
+			}
 			return NewErrorPushResponse("unknown transport error")
 		}
 
@@ -190,6 +225,14 @@ func (me *AppleNotificationServer) SendNotification(msg *PushNotification) PushR
 				return NewRemovePushResponse()
 			}
 
+			if isAppleTransientError(res.Reason) {
+				me.logger.Errorf("Failed to send apple push, will retry res ApnsID=%v reason=%v code=%v type=%v", res.ApnsID, res.Reason, res.StatusCode, me.ApplePushSettings.Type)
+				if me.metrics != nil {
+					me.metrics.incrementFailure(PushNotifyApple, pushType, res.Reason)
+				}
+				return NewTransientErrorPushResponse(res.Reason, retryAfter.get())
+			}
+
 			me.logger.Errorf("Failed to send apple push with res ApnsID=%v reason=%v code=%v type=%v", res.ApnsID, res.Reason, res.StatusCode, me.ApplePushSettings.Type)
 			if me.metrics != nil {
 				me.metrics.incrementFailure(PushNotifyApple, pushType, res.Reason)
@@ -206,3 +249,13 @@ func (me *AppleNotificationServer) SendNotification(msg *PushNotification) PushR
 	}
 	return NewOkPushResponse()
 }
+
+// isAppleTransientError tells whether APNs may accept the notification when
+// it is sent again later.
+func isAppleTransientError(reason string) bool {
+	switch reason {
+	case apns.ReasonTooManyRequests, apns.ReasonInternalServerError, apns.ReasonServiceUnavailable, apns.ReasonShutdown:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	apns "github.com/sideshow/apns2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppleTokenAuthentication(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "AuthKey*.p8")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, f.Close())
+
+	logger := NewLogger(&ConfigPushProxy{EnableConsoleLog: true})
+
+	srv := NewAppleNotificationServer(ApplePushSettings{
+		Type:             "apple",
+		ApplePushAuthKey: f.Name(),
+	}, logger, nil)
+	require.False(t, srv.Initialize(), "key and team ids are required")
+
+	srv = NewAppleNotificationServer(ApplePushSettings{
+		Type:             "apple",
+		ApplePushAuthKey: f.Name(),
+		ApplePushKeyID:   "KEYID",
+		ApplePushTeamID:  "TEAMID",
+	}, logger, nil)
+	require.True(t, srv.Initialize())
+
+	client := srv.(*AppleNotificationServer).AppleClient
+	require.NotNil(t, client.Token)
+	require.Equal(t, apns.HostProduction, client.Host)
+	require.True(t, client.Token.Expired())
+	client.Token.GenerateIfExpired()
+	require.NotEmpty(t, client.Token.Bearer)
+	require.False(t, client.Token.Expired())
+}
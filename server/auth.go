@@ -0,0 +1,261 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HEADER_SERVER_ID = "X-Push-Proxy-Server-Id"
+	HEADER_TIMESTAMP = "X-Push-Proxy-Timestamp"
+	HEADER_SIGNATURE = "X-Push-Proxy-Signature"
+
+	defaultAuthMaxSkew  = 5 * time.Minute
+	minReplayCachePrune = 1024
+	authReasonMissing   = "missing_credentials"
+	authReasonToken     = "invalid_token"
+	authReasonSignature = "invalid_signature"
+	authReasonTimestamp = "invalid_timestamp"
+	authReasonReplay    = "replay"
+	authReasonServerID  = "server_id_mismatch"
+)
+
+type authServerIDKey struct{}
+
+// authenticatedServerID returns the ServerID the request was authenticated
+// as, if any.
+func authenticatedServerID(ctx context.Context) string {
+	serverID, _ := ctx.Value(authServerIDKey{}).(string)
+	return serverID
+}
+
+// serverAuthenticator checks that send requests come from the Mattermost
+// server they claim to be from. A server either presents a client
+// certificate mapped to its ServerID, signs the body with its shared secret,
+// with a timestamp to stop replays, or sends a bearer token.
+type serverAuthenticator struct {
+	secrets  map[string][]byte
+	tokens   map[string]string
+	certs    map[string]string
+	required bool
+	maxSkew  time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	nextPrune int
+}
+
+// newServerAuthenticator returns nil when authentication is not configured.
+func newServerAuthenticator(cfg *ConfigPushProxy) (*serverAuthenticator, error) {
+	if len(cfg.ServerAuth) == 0 && len(cfg.TLSClientServerIDs) == 0 && !cfg.RequireServerAuth {
+		return nil, nil
+	}
+
+	a := &serverAuthenticator{
+		secrets:   make(map[string][]byte),
+		tokens:    make(map[string]string),
+		certs:     cfg.TLSClientServerIDs,
+		required:  cfg.RequireServerAuth,
+		maxSkew:   time.Duration(cfg.ServerAuthMaxSkewSeconds) * time.Second,
+		seen:      make(map[string]time.Time),
+		nextPrune: minReplayCachePrune,
+	}
+	if a.maxSkew <= 0 {
+		a.maxSkew = defaultAuthMaxSkew
+	}
+
+	for _, settings := range cfg.ServerAuth {
+		if settings.ServerID == "" {
+			return nil, fmt.Errorf("server auth entry without ServerID")
+		}
+		if settings.Secret == "" && settings.Token == "" {
+			return nil, fmt.Errorf("server auth entry serverId=%v has neither Secret nor Token", settings.ServerID)
+		}
+		if settings.Secret != "" {
+			a.secrets[settings.ServerID] = []byte(settings.Secret)
+		}
+		if settings.Token != "" {
+			if _, ok := a.tokens[settings.Token]; ok {
+				return nil, fmt.Errorf("server auth token of serverId=%v is already used", settings.ServerID)
+			}
+			a.tokens[settings.Token] = settings.ServerID
+		}
+	}
+	return a, nil
+}
+
+// authenticate returns the ServerID the request is authenticated as, or ""
+// for a request without credentials. On failure it returns the reason.
+func (a *serverAuthenticator) authenticate(r *http.Request) (string, string) {
+	if serverID := clientCertServerID(r, a.certs); serverID != "" {
+		return serverID, ""
+	}
+
+	if signature := r.Header.Get(HEADER_SIGNATURE); signature != "" {
+		return a.checkSignature(r, signature)
+	}
+
+	auth := r.Header.Get(HEADER_AUTHORIZATION)
+	if auth == "" {
+		if a.required {
+			return "", authReasonMissing
+		}
+		return "", ""
+	}
+	if !strings.HasPrefix(auth, AUTH_BEARER_PREFIX) {
+		return "", authReasonToken
+	}
+	token := strings.TrimPrefix(auth, AUTH_BEARER_PREFIX)
+	for known, serverID := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return serverID, ""
+		}
+	}
+	return "", authReasonToken
+}
+
+// checkSignature verifies the hex HMAC-SHA256 of "<timestamp>.<body>" made
+// with the secret of the server named in HEADER_SERVER_ID. The body is read
+// and put back for the handler.
+func (a *serverAuthenticator) checkSignature(r *http.Request, signature string) (string, string) {
+	serverID := r.Header.Get(HEADER_SERVER_ID)
+	secret, ok := a.secrets[serverID]
+	if !ok {
+		return "", authReasonSignature
+	}
+
+	timestamp := r.Header.Get(HEADER_TIMESTAMP)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", authReasonTimestamp
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > a.maxSkew || skew < -a.maxSkew {
+		return "", authReasonTimestamp
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", authReasonSignature
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, signBody(secret, timestamp, body)) {
+		return "", authReasonSignature
+	}
+
+	// hex accepts both cases: the decoded MAC identifies the request.
+	if !a.remember(serverID+":"+hex.EncodeToString(expected), signedAt.Add(a.maxSkew)) {
+		return "", authReasonReplay
+	}
+	return serverID, ""
+}
+
+func signBody(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// remember records a signature until it expires and returns false if it was
+// already seen. Once a signature expires its timestamp is rejected anyway.
+func (a *serverAuthenticator) remember(key string, expires time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if until, ok := a.seen[key]; ok && now.Before(until) {
+		return false
+	}
+	if len(a.seen) >= a.nextPrune {
+		for k, until := range a.seen {
+			if !now.Before(until) {
+				delete(a.seen, k)
+			}
+		}
+		a.nextPrune = 2 * len(a.seen)
+		if a.nextPrune < minReplayCachePrune {
+			a.nextPrune = minReplayCachePrune
+		}
+	}
+	a.seen[key] = expires
+	return true
+}
+
+// authorize checks that a notification for serverID may be sent by the
+// request of ctx. It returns the HTTP status and reason of a rejection.
+func (a *serverAuthenticator) authorize(ctx context.Context, serverID string) (int, string) {
+	authenticated := authenticatedServerID(ctx)
+	if authenticated == "" {
+		if a.protects(serverID) {
+			return http.StatusUnauthorized, authReasonMissing
+		}
+		return 0, ""
+	}
+	if authenticated != serverID {
+		return http.StatusForbidden, authReasonServerID
+	}
+	return 0, ""
+}
+
+func (a *serverAuthenticator) protects(serverID string) bool {
+	if a.required {
+		return true
+	}
+	if _, ok := a.secrets[serverID]; ok {
+		return true
+	}
+	for _, id := range a.tokens {
+		if id == serverID {
+			return true
+		}
+	}
+	for _, id := range a.certs {
+		if id == serverID {
+			return true
+		}
+	}
+	return false
+}
+
+// serverAuthMiddleware authenticates the send requests and stores the
+// ServerID they are authenticated as in their context.
+func (s *Server) serverAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			next(w, r)
+			return
+		}
+
+		serverID, reason := s.auth.authenticate(r)
+		if reason != "" {
+			s.logger.Errorf("%v: authentication failed reason=%v ip=%v", r.URL.Path, reason, s.getIpAddress(r))
+			if s.metrics != nil {
+				s.metrics.incrementAuthFailure(reason)
+			}
+			writeJSONError(w, http.StatusUnauthorized, "authentication failed: "+reason)
+			return
+		}
+		if serverID != "" {
+			r = r.WithContext(context.WithValue(r.Context(), authServerIDKey{}, serverID))
+		}
+		next(w, r)
+	}
+}
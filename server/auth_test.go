@@ -0,0 +1,96 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerAuthentication(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true, ServerAuth: []ServerAuthSettings{
+		{ServerID: "signed", Secret: "s3cret"},
+		{ServerID: "bearer", Token: "t0ken"},
+	}}
+	srv := New(cfg, NewLogger(cfg))
+	auth, err := newServerAuthenticator(cfg)
+	require.NoError(t, err)
+	srv.auth = auth
+	srv.pushTargets["apple"] = &fakeNotificationServer{}
+	handler := srv.serverAuthMiddleware(srv.handleSendNotification)
+
+	body := func(serverID string) string {
+		return `{"platform":"apple","server_id":"` + serverID + `","device_id":"did"}`
+	}
+	send := func(body string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/send_push", strings.NewReader(body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	signed := func(serverID, secret, body string, at time.Time) map[string]string {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		return map[string]string{
+			HEADER_SERVER_ID: serverID,
+			HEADER_TIMESTAMP: timestamp,
+			HEADER_SIGNATURE: hex.EncodeToString(signBody([]byte(secret), timestamp, []byte(body))),
+		}
+	}
+
+	t.Run("signed requests", func(t *testing.T) {
+		headers := signed("signed", "s3cret", body("signed"), time.Now())
+		w := send(body("signed"), headers)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, PUSH_STATUS_OK, PushResponseFromJson(w.Body)[PUSH_STATUS])
+
+		assert.Equal(t, http.StatusUnauthorized, send(body("signed"), headers).Code, "replayed")
+		headers[HEADER_SIGNATURE] = strings.ToUpper(headers[HEADER_SIGNATURE])
+		assert.Equal(t, http.StatusUnauthorized, send(body("signed"), headers).Code, "replayed upper-cased")
+		assert.Equal(t, http.StatusUnauthorized, send(body("signed"), signed("signed", "wrong", body("signed"), time.Now())).Code)
+		assert.Equal(t, http.StatusUnauthorized, send(body("signed"), signed("signed", "s3cret", body("other"), time.Now())).Code)
+		assert.Equal(t, http.StatusUnauthorized, send(body("signed"), signed("signed", "s3cret", body("signed"), time.Now().Add(-time.Hour))).Code)
+		assert.Equal(t, http.StatusForbidden, send(body("bearer"), signed("signed", "s3cret", body("bearer"), time.Now())).Code)
+	})
+
+	t.Run("bearer tokens", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send(body("bearer"), map[string]string{HEADER_AUTHORIZATION: "Bearer t0ken"}).Code)
+		assert.Equal(t, http.StatusUnauthorized, send(body("bearer"), map[string]string{HEADER_AUTHORIZATION: "Bearer nope"}).Code)
+		assert.Equal(t, http.StatusForbidden, send(body("signed"), map[string]string{HEADER_AUTHORIZATION: "Bearer t0ken"}).Code)
+	})
+
+	t.Run("anonymous requests", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, send(body("signed"), nil).Code)
+		assert.Equal(t, http.StatusOK, send(body("other"), nil).Code)
+
+		srv.auth.required = true
+		defer func() { srv.auth.required = false }()
+		w := send(body("other"), nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, PUSH_STATUS_FAIL, PushResponseFromJson(w.Body)[PUSH_STATUS])
+	})
+}
+
+func TestServerAuthenticationConfig(t *testing.T) {
+	auth, err := newServerAuthenticator(&ConfigPushProxy{})
+	require.NoError(t, err)
+	assert.Nil(t, auth)
+
+	_, err = newServerAuthenticator(&ConfigPushProxy{ServerAuth: []ServerAuthSettings{{ServerID: "sid"}}})
+	assert.Error(t, err)
+	_, err = newServerAuthenticator(&ConfigPushProxy{ServerAuth: []ServerAuthSettings{{Secret: "s"}}})
+	assert.Error(t, err)
+	_, err = newServerAuthenticator(&ConfigPushProxy{ServerAuth: []ServerAuthSettings{{ServerID: "a", Token: "t"}, {ServerID: "b", Token: "t"}}})
+	assert.Error(t, err)
+}
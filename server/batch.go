@@ -0,0 +1,230 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+const (
+	PUSH_DEVICE_ID = "device_id"
+
+	defaultMaxBatchSize     = 1000
+	defaultBatchConcurrency = 32
+)
+
+// PushNotificationBatch is one notification sent to many devices. DeviceIDs
+// replaces the DeviceID of the notification.
+type PushNotificationBatch struct {
+	PushNotification
+	DeviceIDs []string `json:"device_ids"`
+}
+
+// PushNotificationsFromBatchJson reads either an array of notifications or
+// a single notification with device_ids.
+func PushNotificationsFromBatchJson(data io.Reader) ([]*PushNotification, error) {
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '[' {
+		var msgs []*PushNotification
+		if err := json.Unmarshal(trimmed, &msgs); err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg == nil {
+				return nil, fmt.Errorf("null notification in batch")
+			}
+		}
+		return msgs, nil
+	}
+
+	var batch PushNotificationBatch
+	if err := json.Unmarshal(buf, &batch); err != nil {
+		return nil, err
+	}
+	msgs := make([]*PushNotification, 0, len(batch.DeviceIDs))
+	for _, deviceID := range batch.DeviceIDs {
+		msg := batch.PushNotification
+		msg.DeviceID = deviceID
+		msgs = append(msgs, &msg)
+	}
+	return msgs, nil
+}
+
+// multicastNotificationServer is implemented by the push targets able to
+// send one notification to many devices in a single provider request, and by
+// the servers decorating them. msgs only differ by their DeviceID; one
+// response is returned per notification, in order.
+type multicastNotificationServer interface {
+	sendMulticast(ctx context.Context, msgs []*PushNotification) []PushResponse
+}
+
+// canMulticast tells whether server and every server it decorates send
+// multicasts.
+func canMulticast(server NotificationServer) bool {
+	for {
+		if _, ok := server.(multicastNotificationServer); !ok {
+			return false
+		}
+		wrapped, ok := server.(wrappedNotificationServer)
+		if !ok {
+			return true
+		}
+		server = wrapped.unwrap()
+	}
+}
+
+// multicastGroup is the notifications of a batch sent in one multicast.
+type multicastGroup struct {
+	server  multicastNotificationServer
+	indexes []int
+	msgs    []*PushNotification
+	entries []*dedupEntry
+}
+
+// groupMulticasts checks the notifications whose push target can multicast
+// and groups those with the same payload. The results of the rejected ones
+// are set; it returns the indexes of the notifications to send one by one.
+func (s *Server) groupMulticasts(ctx context.Context, msgs []*PushNotification, results []PushResponse) ([]*multicastGroup, []int) {
+	var groups []*multicastGroup
+	byPayload := make(map[string]*multicastGroup)
+	var singles []int
+	for i, msg := range msgs {
+		server, ok := s.pushTargets[msg.Platform]
+		if _, queued := s.queues[msg.Platform]; !ok || queued || !canMulticast(server) {
+			singles = append(singles, i)
+			continue
+		}
+		if resp, _ := s.checkPushNotification(ctx, msg); resp != nil {
+			results[i] = batchResult(msg, resp)
+			continue
+		}
+
+		var entry *dedupEntry
+		if s.dedup != nil && msg.ID != "" {
+			var first bool
+			entry, first = s.dedup.begin(dedupKey{serverID: msg.ServerID, deviceID: msg.DeviceID, id: msg.ID})
+			if !first {
+				// Answered from the cache by sendPushNotification.
+				singles = append(singles, i)
+				continue
+			}
+		}
+		if resp, status := s.admitPushNotification(msg); resp != nil {
+			if entry != nil {
+				s.dedup.finish(entry, resp, status)
+			}
+			results[i] = batchResult(msg, resp)
+			continue
+		}
+
+		payload := *msg
+		payload.DeviceID = ""
+		key, _ := json.Marshal(&payload)
+		group, ok := byPayload[string(key)]
+		if !ok {
+			group = &multicastGroup{server: server.(multicastNotificationServer)}
+			byPayload[string(key)] = group
+			groups = append(groups, group)
+		}
+		group.indexes = append(group.indexes, i)
+		group.msgs = append(group.msgs, msg)
+		group.entries = append(group.entries, entry)
+	}
+	return groups, singles
+}
+
+func batchResult(msg *PushNotification, resp PushResponse) PushResponse {
+	result := PushResponse{PUSH_DEVICE_ID: msg.DeviceID}
+	for k, v := range resp {
+		result[k] = v
+	}
+	return result
+}
+
+// handleSendNotificationBatch sends every notification of the batch
+// concurrently and answers with one response per notification, in order.
+// APNs requests share the HTTP/2 connection of their push target; the
+// notifications with the same payload for a legacy FCM target are sent as
+// multicasts.
+func (s *Server) handleSendNotificationBatch(w http.ResponseWriter, r *http.Request) {
+	msgs, err := PushNotificationsFromBatchJson(r.Body)
+	if err != nil || len(msgs) == 0 {
+		rMsg := "Failed to read batch body"
+		s.logger.Errorf("%v err=%v", rMsg, err)
+		if s.metrics != nil {
+			s.metrics.incrementBadRequest()
+		}
+		writeJSONError(w, http.StatusBadRequest, rMsg)
+		return
+	}
+
+	maxBatchSize := s.cfg.MaxBatchSize
+	if maxBatchSize <= 0 {
+		maxBatchSize = defaultMaxBatchSize
+	}
+	if len(msgs) > maxBatchSize {
+		rMsg := fmt.Sprintf("Batch of %v notifications exceeds the maximum of %v", len(msgs), maxBatchSize)
+		s.logger.Error(rMsg)
+		if s.metrics != nil {
+			s.metrics.incrementBadRequest()
+		}
+		writeJSONError(w, http.StatusRequestEntityTooLarge, rMsg)
+		return
+	}
+
+	concurrency := s.cfg.BatchConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultBatchConcurrency
+	}
+
+	ctx := r.Context()
+	results := make([]PushResponse, len(msgs))
+	groups, singles := s.groupMulticasts(ctx, msgs, results)
+
+	// The multicasts go first: duplicates sent one by one may wait for them.
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(group *multicastGroup) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			for j, resp := range group.server.sendMulticast(ctx, group.msgs) {
+				msg := group.msgs[j]
+				s.deadLetterAborted(ctx, msg, resp)
+				if entry := group.entries[j]; entry != nil {
+					s.dedup.finish(entry, resp, http.StatusOK)
+				}
+				results[group.indexes[j]] = batchResult(msg, resp)
+			}
+		}(group)
+	}
+	for _, i := range singles {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, msg *PushNotification) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			resp, _ := s.sendPushNotification(ctx, msg)
+			results[i] = batchResult(msg, resp)
+		}(i, msgs[i])
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type deviceNotificationServer struct {
+	responses map[string]PushResponse
+}
+
+func (d *deviceNotificationServer) Initialize() bool { return true }
+
+func (d *deviceNotificationServer) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
+	if resp, ok := d.responses[msg.DeviceID]; ok {
+		return resp
+	}
+	return NewOkPushResponse()
+}
+
+func TestSendNotificationBatch(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true, MaxBatchSize: 3, BatchConcurrency: 2}
+	srv := New(cfg, NewLogger(cfg))
+	srv.pushTargets["apple"] = &deviceNotificationServer{responses: map[string]PushResponse{
+		"gone":   NewRemovePushResponse(),
+		"broken": NewErrorPushResponse("BadTopic"),
+	}}
+
+	send := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.handleSendNotificationBatch(rec, httptest.NewRequest("POST", "/api/v1/send_push_batch", strings.NewReader(body)))
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) []PushResponse {
+		var results []PushResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+		return results
+	}
+
+	t.Run("device_ids payload", func(t *testing.T) {
+		rec := send(`{"platform":"apple","server_id":"sid","message":"hi","device_ids":["ok","gone","broken"]}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		results := decode(rec)
+		require.Len(t, results, 3)
+		assert.Equal(t, PushResponse{PUSH_STATUS: PUSH_STATUS_OK, PUSH_DEVICE_ID: "ok"}, results[0])
+		assert.Equal(t, PushResponse{PUSH_STATUS: PUSH_STATUS_REMOVE, PUSH_DEVICE_ID: "gone"}, results[1])
+		assert.Equal(t, PUSH_STATUS_FAIL, results[2][PUSH_STATUS])
+		assert.Equal(t, "BadTopic", results[2][PUSH_STATUS_ERROR_MSG])
+	})
+
+	t.Run("array payload", func(t *testing.T) {
+		rec := send(`[{"platform":"apple","server_id":"sid","device_id":"ok"},{"platform":"android","server_id":"sid","device_id":"other"}]`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		results := decode(rec)
+		require.Len(t, results, 2)
+		assert.Equal(t, PUSH_STATUS_OK, results[0][PUSH_STATUS])
+		assert.Equal(t, PUSH_STATUS_FAIL, results[1][PUSH_STATUS], "unknown platform")
+		assert.Equal(t, "other", results[1][PUSH_DEVICE_ID])
+	})
+
+	t.Run("invalid payloads", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, send(`not json`).Code)
+		assert.Equal(t, http.StatusBadRequest, send(`[]`).Code)
+		assert.Equal(t, http.StatusBadRequest, send(`[null]`).Code)
+		assert.Equal(t, http.StatusBadRequest, send(`{"platform":"apple","server_id":"sid"}`).Code)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, send(`{"platform":"apple","server_id":"sid","device_ids":["a","b","c","d"]}`).Code)
+	})
+}
+
+// hostTransport sends every request to the host of a test server.
+type hostTransport struct {
+	host string
+}
+
+func (h *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = "http"
+	req.URL.Host = h.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSendNotificationBatchMulticast(t *testing.T) {
+	var mu sync.Mutex
+	var requests [][]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			To              string   `json:"to"`
+			RegistrationIDs []string `json:"registration_ids"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		ids := payload.RegistrationIDs
+		if payload.To != "" {
+			ids = []string{payload.To}
+		}
+		mu.Lock()
+		first := len(requests) == 0
+		requests = append(requests, ids)
+		mu.Unlock()
+
+		var results []string
+		failures := 0
+		for _, id := range ids {
+			switch {
+			case id == "gone":
+				results = append(results, `{"error":"NotRegistered"}`)
+				failures++
+			case id == "busy" && first:
+				results = append(results, `{"error":"Unavailable"}`)
+				failures++
+			default:
+				results = append(results, `{"message_id":"1"}`)
+			}
+		}
+		_, _ = fmt.Fprintf(w, `{"success":%v,"failure":%v,"results":[%v]}`, len(ids)-failures, failures, strings.Join(results, ","))
+	}))
+	defer ts.Close()
+
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	srv := New(cfg, logger)
+	android := NewAndroidNotificationServer(AndroidPushSettings{Type: PushNotifyAndroid, AndroidAPIKey: "key"}, logger, nil).(*AndroidNotificationServer)
+	android.client.Transport = &retryAfterTransport{base: &hostTransport{host: strings.TrimPrefix(ts.URL, "http://")}}
+	breaker := newCircuitBreaker(PushNotifyAndroid, android, CircuitBreakerSettings{}, logger, nil)
+	srv.addPushTarget(PushNotifyAndroid, newRetryNotificationServer(PushNotifyAndroid, breaker, RetrySettings{MaxAttempts: 2, BaseBackoffMs: 1, MaxBackoffMs: 10}, nil, logger, nil), DeliverySettings{})
+	require.True(t, canMulticast(srv.pushTargets[PushNotifyAndroid]))
+
+	rec := httptest.NewRecorder()
+	body := `{"platform":"android","server_id":"sid","message":"hi","device_ids":["ok","gone","busy"]}`
+	srv.handleSendNotificationBatch(rec, httptest.NewRequest("POST", "/api/v1/send_push_batch", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var results []PushResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	require.Len(t, results, 3)
+	assert.Equal(t, PushResponse{PUSH_STATUS: PUSH_STATUS_OK, PUSH_DEVICE_ID: "ok"}, results[0])
+	assert.Equal(t, PushResponse{PUSH_STATUS: PUSH_STATUS_REMOVE, PUSH_DEVICE_ID: "gone"}, results[1])
+	assert.Equal(t, PushResponse{PUSH_STATUS: PUSH_STATUS_OK, PUSH_DEVICE_ID: "busy"}, results[2])
+
+	// One multicast, then the retry of the device that was unavailable.
+	assert.Equal(t, [][]string{{"ok", "gone", "busy"}, {"busy"}}, requests)
+	assert.False(t, canMulticast(&deviceNotificationServer{}))
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	PUSH_ERROR_CIRCUIT_OPEN = "circuit breaker open"
+
+	CircuitClosed   = "closed"
+	CircuitHalfOpen = "half-open"
+	CircuitOpen     = "open"
+
+	defaultCircuitConsecutiveFailures = 5
+	defaultCircuitMinRequests         = 20
+	defaultCircuitWindow              = time.Minute
+	defaultCircuitOpenDuration        = 30 * time.Second
+)
+
+// circuitStateValues are the values of the circuit breaker state gauge.
+var circuitStateValues = map[string]float64{
+	CircuitClosed:   0,
+	CircuitHalfOpen: 1,
+	CircuitOpen:     2,
+}
+
+// circuitBreaker stops calling a push target that keeps failing with
+// transient errors, so that requests fail fast instead of waiting for network
+// timeouts. Once open for a while, a single probe request is let through; the
+// breaker closes again if it succeeds.
+type circuitBreaker struct {
+	NotificationServer
+	pushType            string
+	consecutiveFailures int
+	errorRatePercent    int
+	minRequests         int
+	window              time.Duration
+	openDuration        time.Duration
+	metrics             *metrics
+	logger              *Logger
+
+	mu          sync.Mutex
+	state       string
+	failures    int
+	windowStart time.Time
+	requests    int
+	errors      int
+	openedAt    time.Time
+	probing     bool
+}
+
+func newCircuitBreaker(pushType string, server NotificationServer, settings CircuitBreakerSettings, logger *Logger, metrics *metrics) *circuitBreaker {
+	cb := &circuitBreaker{
+		NotificationServer:  server,
+		pushType:            pushType,
+		consecutiveFailures: settings.ConsecutiveFailures,
+		errorRatePercent:    settings.ErrorRatePercent,
+		minRequests:         settings.MinRequests,
+		window:              time.Duration(settings.WindowSeconds) * time.Second,
+		openDuration:        time.Duration(settings.OpenSeconds) * time.Second,
+		metrics:             metrics,
+		logger:              logger,
+		state:               CircuitClosed,
+		windowStart:         time.Now(),
+	}
+	if cb.consecutiveFailures <= 0 && cb.errorRatePercent <= 0 {
+		cb.consecutiveFailures = defaultCircuitConsecutiveFailures
+	}
+	if cb.minRequests <= 0 {
+		cb.minRequests = defaultCircuitMinRequests
+	}
+	if cb.window <= 0 {
+		cb.window = defaultCircuitWindow
+	}
+	if cb.openDuration <= 0 {
+		cb.openDuration = defaultCircuitOpenDuration
+	}
+	if metrics != nil {
+		metrics.setCircuitBreakerState(pushType, circuitStateValues[CircuitClosed])
+	}
+	return cb
+}
+
+func (cb *circuitBreaker) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
+	if !cb.allow() {
+		return NewErrorPushResponse(PUSH_ERROR_CIRCUIT_OPEN)
+	}
+
+	resp := cb.NotificationServer.SendNotification(ctx, msg)
+	// Requests aborted by the caller say nothing about the provider health.
+	if ctx.Err() != nil {
+		cb.skip()
+		return resp
+	}
+	cb.record(!resp.retryable())
+	return resp
+}
+
+// sendMulticast counts a multicast as one request, failed when every device
+// got a transient error.
+func (cb *circuitBreaker) sendMulticast(ctx context.Context, msgs []*PushNotification) []PushResponse {
+	if !cb.allow() {
+		resps := make([]PushResponse, len(msgs))
+		for i := range resps {
+			resps[i] = NewErrorPushResponse(PUSH_ERROR_CIRCUIT_OPEN)
+		}
+		return resps
+	}
+
+	resps := cb.NotificationServer.(multicastNotificationServer).sendMulticast(ctx, msgs)
+	success := false
+	for _, resp := range resps {
+		if !resp.retryable() {
+			success = true
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		cb.skip()
+		return resps
+	}
+	cb.record(success)
+	return resps
+}
+
+func (cb *circuitBreaker) unwrap() NotificationServer {
+	return cb.NotificationServer
+}
+
+// State returns the current state of the breaker.
+func (cb *circuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// allow tells whether a request may be sent, moving an open breaker to
+// half-open once it has been open long enough.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.openDuration {
+			return false
+		}
+		cb.setState(CircuitHalfOpen)
+		cb.probing = true
+		return true
+	case CircuitHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	}
+	return true
+}
+
+// record accounts for the outcome of a request. Only transient failures
+// count as failures: the provider answering with a permanent error is
+// healthy.
+func (cb *circuitBreaker) record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitHalfOpen {
+		cb.probing = false
+		if success {
+			cb.reset()
+			cb.setState(CircuitClosed)
+		} else {
+			cb.open()
+		}
+		return
+	}
+
+	if time.Since(cb.windowStart) > cb.window {
+		cb.windowStart = time.Now()
+		cb.requests = 0
+		cb.errors = 0
+	}
+	cb.requests++
+	if success {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	cb.errors++
+
+	if cb.consecutiveFailures > 0 && cb.failures >= cb.consecutiveFailures {
+		cb.open()
+	} else if cb.errorRatePercent > 0 && cb.requests >= cb.minRequests && cb.errors*100 >= cb.errorRatePercent*cb.requests {
+		cb.open()
+	}
+}
+
+// skip accounts for a request aborted by the caller: it is not counted, and
+// a half-open breaker lets another probe through.
+func (cb *circuitBreaker) skip() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitHalfOpen {
+		cb.probing = false
+	}
+}
+
+// open trips the breaker. It must be called with the lock held.
+func (cb *circuitBreaker) open() {
+	cb.logger.Errorf("Circuit breaker opened for type=%v consecutiveFailures=%v errors=%v/%v", cb.pushType, cb.failures, cb.errors, cb.requests)
+	cb.reset()
+	cb.openedAt = time.Now()
+	cb.setState(CircuitOpen)
+}
+
+func (cb *circuitBreaker) reset() {
+	cb.failures = 0
+	cb.requests = 0
+	cb.errors = 0
+	cb.windowStart = time.Now()
+}
+
+func (cb *circuitBreaker) setState(state string) {
+	if cb.state == state {
+		return
+	}
+	cb.logger.Infof("Circuit breaker for type=%v is %v", cb.pushType, state)
+	cb.state = state
+	if cb.metrics != nil {
+		cb.metrics.setCircuitBreakerState(cb.pushType, circuitStateValues[state])
+	}
+}
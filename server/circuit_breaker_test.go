@@ -0,0 +1,141 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	msg := &PushNotification{ServerID: "sid", DeviceID: "did"}
+	transient := NewTransientErrorPushResponse("unknown transport error", 0)
+
+	t.Run("opens after consecutive failures", func(t *testing.T) {
+		target := &fakeNotificationServer{responses: []PushResponse{transient}}
+		cb := newCircuitBreaker("apple", target, CircuitBreakerSettings{ConsecutiveFailures: 3}, logger, nil)
+
+		for i := 0; i < 3; i++ {
+			cb.SendNotification(context.Background(), msg)
+		}
+		assert.Equal(t, CircuitOpen, cb.State())
+
+		resp := cb.SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, PUSH_ERROR_CIRCUIT_OPEN, resp[PUSH_STATUS_ERROR_MSG])
+		assert.False(t, resp.retryable())
+		assert.Equal(t, 3, target.count())
+	})
+
+	t.Run("permanent errors do not count", func(t *testing.T) {
+		target := &fakeNotificationServer{responses: []PushResponse{NewErrorPushResponse("BadDeviceToken")}}
+		cb := newCircuitBreaker("apple", target, CircuitBreakerSettings{ConsecutiveFailures: 2}, logger, nil)
+
+		for i := 0; i < 5; i++ {
+			cb.SendNotification(context.Background(), msg)
+		}
+		assert.Equal(t, CircuitClosed, cb.State())
+	})
+
+	t.Run("opens on error rate", func(t *testing.T) {
+		target := &fakeNotificationServer{}
+		cb := newCircuitBreaker("apple", target, CircuitBreakerSettings{ErrorRatePercent: 50, MinRequests: 4}, logger, nil)
+
+		for i := 0; i < 3; i++ {
+			target.responses = []PushResponse{NewOkPushResponse()}
+			cb.SendNotification(context.Background(), msg)
+			target.responses = []PushResponse{transient}
+			cb.SendNotification(context.Background(), msg)
+			if i == 0 {
+				assert.Equal(t, CircuitClosed, cb.State())
+			}
+		}
+		assert.Equal(t, CircuitOpen, cb.State())
+	})
+
+	t.Run("half-open probe closes the breaker", func(t *testing.T) {
+		target := &fakeNotificationServer{responses: []PushResponse{transient}}
+		cb := newCircuitBreaker("apple", target, CircuitBreakerSettings{ConsecutiveFailures: 1, OpenSeconds: 1}, logger, nil)
+
+		cb.SendNotification(context.Background(), msg)
+		require.Equal(t, CircuitOpen, cb.State())
+
+		// Pretend the breaker has been open long enough.
+		cb.mu.Lock()
+		cb.openedAt = time.Now().Add(-2 * time.Second)
+		cb.mu.Unlock()
+
+		require.True(t, cb.allow())
+		assert.Equal(t, CircuitHalfOpen, cb.State())
+		assert.False(t, cb.allow(), "only one probe at a time")
+		cb.record(false)
+		assert.Equal(t, CircuitOpen, cb.State())
+
+		cb.mu.Lock()
+		cb.openedAt = time.Now().Add(-2 * time.Second)
+		cb.mu.Unlock()
+
+		target.responses = []PushResponse{NewOkPushResponse()}
+		resp := cb.SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_OK, resp[PUSH_STATUS])
+		assert.Equal(t, CircuitClosed, cb.State())
+	})
+
+	t.Run("aborted requests are not counted", func(t *testing.T) {
+		target := &fakeNotificationServer{responses: []PushResponse{transient}}
+		cb := newCircuitBreaker("apple", target, CircuitBreakerSettings{ConsecutiveFailures: 2, OpenSeconds: 1}, logger, nil)
+		aborted, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// An aborted request does not reset the consecutive failures.
+		cb.SendNotification(context.Background(), msg)
+		cb.SendNotification(aborted, msg)
+		cb.SendNotification(context.Background(), msg)
+		require.Equal(t, CircuitOpen, cb.State())
+
+		cb.mu.Lock()
+		cb.openedAt = time.Now().Add(-2 * time.Second)
+		cb.mu.Unlock()
+
+		// An aborted probe neither closes the breaker nor blocks the next.
+		target.responses = []PushResponse{NewOkPushResponse()}
+		cb.SendNotification(aborted, msg)
+		assert.Equal(t, CircuitHalfOpen, cb.State())
+		require.True(t, cb.allow())
+	})
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	srv := New(cfg, logger)
+
+	target := &fakeNotificationServer{responses: []PushResponse{NewTransientErrorPushResponse("unknown transport error", 0)}}
+	breaker := newCircuitBreaker("apple", target, CircuitBreakerSettings{ConsecutiveFailures: 1}, logger, nil)
+	breaker.SendNotification(context.Background(), &PushNotification{})
+	srv.breakers["apple"] = breaker
+	srv.pushTargets["apple"] = breaker
+	srv.pushTargets["android"] = &fakeNotificationServer{}
+
+	w := httptest.NewRecorder()
+	srv.handleStatus(w, httptest.NewRequest("GET", "/api/v1/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var status ServerStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	require.Len(t, status.PushTargets, 2)
+	assert.Equal(t, "android", status.PushTargets[0].Type)
+	assert.Equal(t, "", status.PushTargets[0].CircuitBreaker)
+	assert.Equal(t, "apple", status.PushTargets[1].Type)
+	assert.Equal(t, CircuitOpen, status.PushTargets[1].CircuitBreaker)
+}
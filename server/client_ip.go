@@ -0,0 +1,93 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks of the load balancers and reverse proxies
+// whose forwarded headers are believed.
+type trustedProxies []*net.IPNet
+
+// newTrustedProxies parses CIDRs and plain IP addresses. It returns nil for
+// an empty list.
+func newTrustedProxies(entries []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (tp trustedProxies) contains(ip net.IP) bool {
+	for _, network := range tp {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of the request. Forwarded
+// headers are only read when the peer is a trusted proxy; X-Forwarded-For
+// is walked from the right, skipping trusted hops, so the entries a client
+// prepends itself are ignored.
+func (tp trustedProxies) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !tp.contains(peer) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header[http.CanonicalHeaderKey(HEADER_FORWARDED)] {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get(HEADER_REAL_IP))); realIP != nil {
+			return realIP.String()
+		}
+		return host
+	}
+
+	client := host
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !tp.contains(ip) {
+			break
+		}
+	}
+	return client
+}
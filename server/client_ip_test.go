@@ -0,0 +1,70 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	require.NoError(t, err)
+	_, err = newTrustedProxies([]string{"junk"})
+	assert.Error(t, err)
+	_, err = newTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	none, err := newTrustedProxies(nil)
+	require.NoError(t, err)
+	assert.Nil(t, none)
+
+	for name, tc := range map[string]struct {
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		expected   string
+	}{
+		"direct client":             {"1.2.3.4:5000", nil, "", "1.2.3.4"},
+		"untrusted peer spoofing":   {"1.2.3.4:5000", []string{"8.8.8.8"}, "8.8.4.4", "1.2.3.4"},
+		"trusted proxy":             {"10.0.0.1:5000", []string{"1.2.3.4"}, "", "1.2.3.4"},
+		"client prepends a hop":     {"10.0.0.1:5000", []string{"8.8.8.8, 1.2.3.4"}, "", "1.2.3.4"},
+		"chain of trusted proxies":  {"10.0.0.1:5000", []string{"8.8.8.8, 1.2.3.4, 192.168.1.1", "10.1.1.1"}, "", "1.2.3.4"},
+		"only trusted hops":         {"10.0.0.1:5000", []string{"10.2.2.2, 10.1.1.1"}, "", "10.2.2.2"},
+		"garbage hop":               {"10.0.0.1:5000", []string{"1.2.3.4, junk, 10.1.1.1"}, "", "10.1.1.1"},
+		"real ip from trusted peer": {"10.0.0.1:5000", nil, "1.2.3.4", "1.2.3.4"},
+		"no forwarded header":       {"10.0.0.1:5000", nil, "", "10.0.0.1"},
+		"ipv6 proxy":                {"[fd00::1]:5000", []string{"2001:db8::1"}, "", "2001:db8::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for _, header := range tc.forwarded {
+			r.Header.Add(HEADER_FORWARDED, header)
+		}
+		if tc.realIP != "" {
+			r.Header.Set(HEADER_REAL_IP, tc.realIP)
+		}
+		assert.Equal(t, tc.expected, proxies.clientIP(r), name)
+	}
+}
+
+func TestThrottleKey(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true, ThrottleVaryByHeader: "X-Forwarded-For X-Tenant"}
+	srv := New(cfg, NewLogger(cfg))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.4:5000"
+	r.Header.Set(HEADER_FORWARDED, "8.8.8.8")
+	r.Header.Set("X-Tenant", "acme")
+
+	// Without trusted proxies the forwarded headers of any caller are ignored.
+	assert.Equal(t, "1.2.3.4", srv.getIpAddress(r))
+	assert.Equal(t, "1.2.3.4\nacme", srv.throttleKey(r))
+
+	srv.proxies, _ = newTrustedProxies([]string{"10.0.0.0/8"})
+	assert.Equal(t, "1.2.3.4", srv.getIpAddress(r))
+	assert.Equal(t, "1.2.3.4\nacme", srv.throttleKey(r))
+}
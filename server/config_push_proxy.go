@@ -19,9 +19,107 @@ type ConfigPushProxy struct {
 	EnableMetrics           bool
 	ApplePushSettings       []ApplePushSettings
 	AndroidPushSettings     []AndroidPushSettings
+	PushTargets             []PushTargetSettings
+	FailoverChains          []FailoverChainSettings
 	EnableConsoleLog        bool
 	EnableFileLog           bool
 	LogFileLocation         string
+	AdminToken              string
+	EnableAsyncDelivery     bool
+	// QueueDirectory makes the asynchronous delivery queue durable by
+	// persisting accepted notifications there until a provider answers.
+	QueueDirectory              string
+	QueueCompactIntervalSeconds int
+	// DeadLetterFile collects, as JSON lines, the notifications that could
+	// not be delivered so they can be replayed later.
+	DeadLetterFile string
+	// On shutdown the proxy reports not-ready for DrainDelaySeconds while
+	// still serving, then waits up to DrainTimeoutSeconds for in-flight and
+	// queued notifications.
+	DrainDelaySeconds   int
+	DrainTimeoutSeconds int
+	// MaxBatchSize caps the notifications of one send_push_batch request,
+	// BatchConcurrency how many of them are sent at the same time.
+	MaxBatchSize     int
+	BatchConcurrency int
+	// A notification sent again with the same server, device and ID within
+	// DedupTTLSeconds gets the first response without reaching the
+	// provider. DedupMaxEntries bounds the responses remembered.
+	DedupTTLSeconds int
+	DedupMaxEntries int
+	// ServerAuth lists the credentials of the Mattermost servers allowed to
+	// send. A listed server must authenticate; with RequireServerAuth every
+	// server must. Signed requests older than ServerAuthMaxSkewSeconds are
+	// rejected.
+	ServerAuth               []ServerAuthSettings
+	RequireServerAuth        bool
+	ServerAuthMaxSkewSeconds int
+	// Servers registers the known Mattermost servers. ServerRegistryFile
+	// persists the registry edited through the admin API and, once it
+	// exists, replaces Servers: later edits of Servers are ignored. With
+	// RejectUnknownServers only registered servers may send.
+	Servers              []ServerRegistrationSettings
+	ServerRegistryFile   string
+	RejectUnknownServers bool
+	// UsageFile enables the per-server usage counters and stores them,
+	// written every UsageFlushIntervalSeconds and on shutdown. The quotas of
+	// the registry count the same sent notifications in memory and need
+	// UsageFile to survive a restart; without it they start over.
+	UsageFile                 string
+	UsageFlushIntervalSeconds int
+	// TLSCertFile and TLSKeyFile serve the API over TLS; both are reloaded
+	// when they change. TLSMinVersion is "1.0" to "1.3", 1.2 by default,
+	// and TLSCipherSuites restricts the TLS 1.2 suites by Go name.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSMinVersion   string
+	TLSCipherSuites []string
+	// TLSClientCAFile requires clients to present a certificate it issued,
+	// unless TLSClientCertOptional. TLSClientServerIDs maps a certificate
+	// subject, or its common name, to the ServerID it authenticates and
+	// requires TLSClientCAFile.
+	TLSClientCAFile       string
+	TLSClientCertOptional bool
+	TLSClientServerIDs    map[string]string
+	// TrustedProxies lists the CIDRs or IPs of the load balancers whose
+	// X-Forwarded-For and X-Real-IP headers are believed; without it the
+	// client IP is the peer address. The throttle varies by the client IP,
+	// so naming a forwarded header in ThrottleVaryByHeader is not needed.
+	// ProxyProtocol expects a PROXY protocol v1 or v2 header on connections
+	// from trusted proxies, and requires TrustedProxies.
+	TrustedProxies []string
+	ProxyProtocol  bool
+}
+
+// ServerAuthSettings are the credentials of one Mattermost server. Secret
+// signs the request body, Token is sent as a bearer token.
+type ServerAuthSettings struct {
+	ServerID string
+	Secret   string
+	Token    string
+}
+
+// ServerRegistrationSettings registers a Mattermost server. Status is
+// "allowed" or "blocked", quotas of 0 are unlimited and an empty Platforms
+// allows every push target type.
+type ServerRegistrationSettings struct {
+	ServerID     string
+	Name         string
+	Status       string
+	DailyQuota   int
+	MonthlyQuota int
+	Platforms    []string
+}
+
+func (me ServerRegistrationSettings) toRegisteredServer() *RegisteredServer {
+	return &RegisteredServer{
+		ServerID:     me.ServerID,
+		Name:         me.Name,
+		Status:       me.Status,
+		DailyQuota:   me.DailyQuota,
+		MonthlyQuota: me.MonthlyQuota,
+		Platforms:    me.Platforms,
+	}
 }
 
 type ApplePushSettings struct {
@@ -30,11 +128,153 @@ type ApplePushSettings struct {
 	ApplePushCertPrivate    string
 	ApplePushCertPassword   string
 	ApplePushTopic          string
+
+	// ApplePushAuthKey is the path to a .p8 token signing key. When set it
+	// takes precedence over ApplePushCertPrivate.
+	ApplePushAuthKey string
+	ApplePushKeyID   string
+	ApplePushTeamID  string
+
+	Delivery DeliverySettings
 }
 
 type AndroidPushSettings struct {
 	Type          string
+	Provider      string
 	AndroidAPIKey string `json:"AndroidApiKey"`
+
+	// AndroidServiceAccountFile is the Google service account JSON file used
+	// by the fcmv1 provider. AndroidFCMSendURL overrides the send endpoint.
+	AndroidServiceAccountFile string
+	AndroidFCMSendURL         string
+
+	// WechatDeviceMapFile stores the device ID to OpenID bindings of the
+	// wechat provider. It defaults to wechat-device-ids.json in the config
+	// directory.
+	WechatDeviceMapFile string
+	WechatTemplate      WechatTemplateSettings
+
+	JPush JPushSettings
+
+	Delivery DeliverySettings
+}
+
+// JPushSettings controls how the jpush provider builds its payload.
+type JPushSettings struct {
+	// Platforms lists the JPush platforms to push to, "android" and/or
+	// "ios". It defaults to android only.
+	Platforms []string
+	// Audience is how the device ID is used to target devices:
+	// "registration_id" (default), "alias" or "tag".
+	Audience string
+	// TimeToLive is how long JPush keeps offline messages, in seconds. Zero
+	// keeps the JPush default.
+	TimeToLive     int
+	ApnsProduction bool
+	OverrideMsgID  int64
+}
+
+// WechatTemplateSettings configures the template message sent by the wechat
+// provider. URL, PagePath and field values are Go templates executed against
+// the PushNotification, e.g. "{{.SenderName}}: {{.Message}}".
+type WechatTemplateSettings struct {
+	TemplateID  string
+	URL         string
+	MiniProgram *WechatMiniProgramSettings
+	Fields      map[string]WechatTemplateField
+}
+
+type WechatMiniProgramSettings struct {
+	AppID    string
+	PagePath string
+}
+
+type WechatTemplateField struct {
+	Value string
+	Color string
+}
+
+// PushTargetSettings is a generic push target configuration block. Provider
+// names a factory registered with RegisterProvider and Settings is handed to
+// it as is.
+type PushTargetSettings struct {
+	Type     string
+	Provider string
+	Settings json.RawMessage
+	Delivery DeliverySettings
+}
+
+// FailoverChainSettings exposes an ordered list of push targets under one
+// Type. A notification goes to the next target when the previous one fails.
+type FailoverChainSettings struct {
+	Type    string
+	Targets []string
+}
+
+// DeliverySettings tunes how notifications are delivered to a push target.
+type DeliverySettings struct {
+	// Workers and QueueSize size the queue drained by the target when
+	// EnableAsyncDelivery is set.
+	Workers   int
+	QueueSize int
+	// ConnectTimeoutMs bounds establishing a connection to the provider,
+	// RequestTimeoutMs a whole request to it.
+	ConnectTimeoutMs int
+	RequestTimeoutMs int
+	Retry            RetrySettings
+	CircuitBreaker   CircuitBreakerSettings
+}
+
+// RetrySettings configures how transient provider failures are retried.
+type RetrySettings struct {
+	// MaxAttempts counts the first attempt, so 1 disables retries.
+	MaxAttempts   int
+	BaseBackoffMs int
+	MaxBackoffMs  int
+	// Jitter randomizes each backoff by up to this fraction, e.g. 0.2.
+	Jitter float64
+}
+
+// CircuitBreakerSettings configures when a failing push target stops being
+// called. The breaker opens after ConsecutiveFailures transient failures in a
+// row, or when at least ErrorRatePercent of the requests of a WindowSeconds
+// window failed, provided it saw MinRequests. It stays open OpenSeconds
+// before letting a probe request through.
+type CircuitBreakerSettings struct {
+	Disabled            bool
+	ConsecutiveFailures int
+	ErrorRatePercent    int
+	MinRequests         int
+	WindowSeconds       int
+	OpenSeconds         int
+}
+
+// pushTargetSettings returns every configured push target, converting the
+// ApplePushSettings and AndroidPushSettings entries into generic blocks.
+func (cfg *ConfigPushProxy) pushTargetSettings() ([]PushTargetSettings, error) {
+	var targets []PushTargetSettings
+
+	for _, settings := range cfg.ApplePushSettings {
+		raw, err := json.Marshal(settings)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, PushTargetSettings{Type: settings.Type, Provider: ProviderAPNS, Settings: raw, Delivery: settings.Delivery})
+	}
+
+	for _, settings := range cfg.AndroidPushSettings {
+		// An empty provider keeps the historical WeChat behaviour.
+		if settings.Provider == "" {
+			settings.Provider = AndroidProviderWechat
+		}
+		raw, err := json.Marshal(settings)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, PushTargetSettings{Type: settings.Type, Provider: settings.Provider, Settings: raw, Delivery: settings.Delivery})
+	}
+
+	return append(targets, cfg.PushTargets...), nil
 }
 
 // FindConfigFile searches for the filepath in a list of directories
@@ -0,0 +1,274 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a notification no provider accepted, along with why.
+type DeadLetter struct {
+	Time     time.Time         `json:"time"`
+	Type     string            `json:"type"`
+	Attempts int               `json:"attempts"`
+	Reason   string            `json:"reason"`
+	Response PushResponse      `json:"response"`
+	Msg      *PushNotification `json:"msg"`
+}
+
+// DeadLetterFilter selects dead letters. Empty fields match everything.
+type DeadLetterFilter struct {
+	Type     string
+	ServerID string
+	Reason   string
+	Since    time.Time
+}
+
+func (f *DeadLetterFilter) Match(letter *DeadLetter) bool {
+	if f.Type != "" && letter.Type != f.Type {
+		return false
+	}
+	if f.ServerID != "" && (letter.Msg == nil || letter.Msg.ServerID != f.ServerID) {
+		return false
+	}
+	if f.Reason != "" && letter.Reason != f.Reason {
+		return false
+	}
+	if !f.Since.IsZero() && letter.Time.Before(f.Since) {
+		return false
+	}
+	return true
+}
+
+// deadLetterStore appends dead letters to a JSON lines file. The file is
+// opened for every write, under the lock of lockDeadLetters, so that it can
+// be rewritten by a replay while the proxy is running.
+type deadLetterStore struct {
+	path   string
+	logger *Logger
+	mu     sync.Mutex
+}
+
+func newDeadLetterStore(path string, logger *Logger) *deadLetterStore {
+	return &deadLetterStore{path: path, logger: logger}
+}
+
+func (d *deadLetterStore) Add(letter *DeadLetter) {
+	buf, err := json.Marshal(letter)
+	if err == nil {
+		err = d.append(append(buf, '\n'))
+	}
+	if err != nil {
+		d.logger.Errorf("Failed to write dead letter sid=%v did=%v type=%v err=%v", letter.Msg.ServerID, letter.Msg.DeviceID, letter.Type, err)
+	}
+}
+
+func (d *deadLetterStore) append(buf []byte) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	lock, err := lockDeadLetters(d.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := lock.unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// deadLetterLock is an exclusive lock on a dead-letter file, shared between
+// the processes appending to and rewriting it. The lock is held on a
+// separate file since a rewrite replaces the dead-letter file.
+type deadLetterLock struct {
+	f *os.File
+}
+
+func lockDeadLetters(fileName string) (*deadLetterLock, error) {
+	f, err := os.OpenFile(fileName+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &deadLetterLock{f: f}, nil
+}
+
+func (l *deadLetterLock) unlock() error {
+	err := unlockFile(l.f)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadDeadLetters returns the dead letters stored in fileName, oldest first,
+// and the size of the file read. Corrupted lines are skipped.
+func ReadDeadLetters(fileName string) ([]*DeadLetter, int64, error) {
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var letters []*DeadLetter
+	var size int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without newline is still being written.
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		size += int64(len(line))
+
+		var letter DeadLetter
+		if json.Unmarshal(line, &letter) != nil || letter.Msg == nil {
+			continue
+		}
+		letters = append(letters, &letter)
+	}
+	return letters, size, nil
+}
+
+// rewriteDeadLetters atomically replaces fileName with letters. Lines
+// appended after the first size bytes were read are kept: appends wait on
+// the lock until the file is replaced.
+func rewriteDeadLetters(fileName string, letters []*DeadLetter, size int64) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	writer := bufio.NewWriter(f)
+	encoder := json.NewEncoder(writer)
+	for _, letter := range letters {
+		if err = encoder.Encode(letter); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	lock, err := lockDeadLetters(fileName)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer func() {
+		if unlockErr := lock.unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	if current, err := os.Open(fileName); err == nil {
+		_, err = current.Seek(size, io.SeekStart)
+		if err == nil {
+			_, err = io.Copy(writer, current)
+		}
+		current.Close()
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fileName)
+}
+
+// ReplayDeadLetters sends again the dead letters of cfg.DeadLetterFile that
+// match filter through the configured push targets. Delivered notifications,
+// and those the provider asked to remove, are dropped from the file; the
+// others are kept with their new failure. It returns how many were delivered
+// and how many failed again.
+func ReplayDeadLetters(cfg *ConfigPushProxy, logger *Logger, filter *DeadLetterFilter) (int, int, error) {
+	replayCfg := *cfg
+	replayCfg.EnableAsyncDelivery = false
+	replayCfg.DeadLetterFile = ""
+	s := New(&replayCfg, logger)
+	s.initPushTargets()
+
+	return replayDeadLetters(cfg.DeadLetterFile, s.pushTargets, logger, filter)
+}
+
+func replayDeadLetters(fileName string, pushTargets map[string]NotificationServer, logger *Logger, filter *DeadLetterFilter) (int, int, error) {
+	letters, size, err := ReadDeadLetters(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var kept []*DeadLetter
+	delivered, failed := 0, 0
+	for _, letter := range letters {
+		if !filter.Match(letter) {
+			kept = append(kept, letter)
+			continue
+		}
+
+		server, ok := pushTargets[letter.Type].(*retryNotificationServer)
+		if !ok {
+			logger.Errorf("Cannot replay dead letter sid=%v did=%v, no push target for type=%v", letter.Msg.ServerID, letter.Msg.DeviceID, letter.Type)
+			kept = append(kept, letter)
+			failed++
+			continue
+		}
+
+		resp, attempts := server.send(context.Background(), letter.Msg)
+		switch resp[PUSH_STATUS] {
+		case PUSH_STATUS_OK:
+			delivered++
+		case PUSH_STATUS_REMOVE:
+			logger.Infof("Dropping dead letter sid=%v did=%v type=%v, device was removed", letter.Msg.ServerID, letter.Msg.DeviceID, letter.Type)
+			delivered++
+		default:
+			letter.Time = time.Now()
+			letter.Attempts += attempts
+			letter.Reason = resp[PUSH_STATUS_ERROR_MSG]
+			letter.Response = resp
+			kept = append(kept, letter)
+			failed++
+		}
+	}
+
+	if err := rewriteDeadLetters(fileName, kept, size); err != nil {
+		return delivered, failed, err
+	}
+	return delivered, failed, nil
+}
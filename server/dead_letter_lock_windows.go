@@ -0,0 +1,23 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+//go:build windows
+// +build windows
+
+package server
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// The lock covers the first byte of the file, which is enough for every
+// process to agree on it.
+func lockFile(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{})
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
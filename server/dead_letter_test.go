@@ -0,0 +1,111 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "deadletters.jsonl")
+
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	store := newDeadLetterStore(fileName, logger)
+	settings := RetrySettings{MaxAttempts: 2, BaseBackoffMs: 1, MaxBackoffMs: 10}
+
+	// A target failing with a transient error ends up in the store once its
+	// retries are exhausted; REMOVE is not dead-lettered.
+	failing := &fakeNotificationServer{responses: []PushResponse{NewTransientErrorPushResponse("ServiceUnavailable", 0)}}
+	apple := newRetryNotificationServer("apple", failing, settings, store, logger, nil)
+	apple.SendNotification(context.Background(), &PushNotification{ServerID: "sid1", DeviceID: "did1"})
+	apple.SendNotification(context.Background(), &PushNotification{ServerID: "sid2", DeviceID: "did2"})
+
+	removing := &fakeNotificationServer{responses: []PushResponse{NewRemovePushResponse()}}
+	newRetryNotificationServer("android", removing, settings, store, logger, nil).SendNotification(context.Background(), &PushNotification{ServerID: "sid1", DeviceID: "did3"})
+
+	letters, _, err := ReadDeadLetters(fileName)
+	require.NoError(t, err)
+	require.Len(t, letters, 2)
+	assert.Equal(t, "apple", letters[0].Type)
+	assert.Equal(t, 2, letters[0].Attempts)
+	assert.Equal(t, "ServiceUnavailable", letters[0].Reason)
+	assert.Equal(t, "did1", letters[0].Msg.DeviceID)
+
+	filter := &DeadLetterFilter{ServerID: "sid1"}
+	assert.True(t, filter.Match(letters[0]))
+	assert.False(t, filter.Match(letters[1]))
+	filter = &DeadLetterFilter{Since: time.Now().Add(time.Minute)}
+	assert.False(t, filter.Match(letters[0]))
+
+	t.Run("replay keeps the notifications still failing", func(t *testing.T) {
+		recovered := &fakeNotificationServer{}
+		targets := map[string]NotificationServer{
+			"apple": newRetryNotificationServer("apple", recovered, settings, nil, logger, nil),
+		}
+
+		delivered, failed, err := replayDeadLetters(fileName, targets, logger, &DeadLetterFilter{ServerID: "sid1"})
+		require.NoError(t, err)
+		assert.Equal(t, 1, delivered)
+		assert.Equal(t, 0, failed)
+		assert.Equal(t, 1, recovered.count())
+
+		recovered.responses = []PushResponse{NewErrorPushResponse("BadTopic")}
+		delivered, failed, err = replayDeadLetters(fileName, targets, logger, &DeadLetterFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, 0, delivered)
+		assert.Equal(t, 1, failed)
+
+		letters, _, err := ReadDeadLetters(fileName)
+		require.NoError(t, err)
+		require.Len(t, letters, 1)
+		assert.Equal(t, "did2", letters[0].Msg.DeviceID)
+		assert.Equal(t, "BadTopic", letters[0].Reason)
+		assert.Equal(t, 3, letters[0].Attempts)
+	})
+}
+
+func TestDeadLetterRewriteLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "deadletters.jsonl")
+
+	logger := NewLogger(&ConfigPushProxy{EnableConsoleLog: true})
+	store := newDeadLetterStore(fileName, logger)
+
+	// An append made while a rewrite holds the lock lands in the new file.
+	lock, err := lockDeadLetters(fileName)
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		store.Add(&DeadLetter{Type: "apple", Msg: &PushNotification{ServerID: "sid", DeviceID: "did"}})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("append did not wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, ioutil.WriteFile(fileName, nil, 0600))
+	require.NoError(t, lock.unlock())
+	<-done
+
+	letters, _, err := ReadDeadLetters(fileName)
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	assert.Equal(t, "did", letters[0].Msg.DeviceID)
+}
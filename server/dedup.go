@@ -0,0 +1,121 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultDedupMaxEntries = 100000
+
+type dedupKey struct {
+	serverID string
+	deviceID string
+	id       string
+}
+
+// dedupEntry holds the response of a notification. done is closed once the
+// first send for the key has answered.
+type dedupEntry struct {
+	key     dedupKey
+	done    chan struct{}
+	resp    PushResponse
+	status  int
+	expires time.Time
+	elem    *list.Element
+}
+
+// dedupCache remembers, for a limited time, the responses of the
+// notifications sent so that a notification retried by the Mattermost server
+// is not delivered twice. The oldest entries are evicted first once
+// maxEntries is reached.
+type dedupCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[dedupKey]*dedupEntry
+	order   *list.List
+}
+
+func newDedupCache(ttl time.Duration, maxEntries int) *dedupCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultDedupMaxEntries
+	}
+	return &dedupCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[dedupKey]*dedupEntry),
+		order:      list.New(),
+	}
+}
+
+// begin returns the entry of the key and whether the caller is the first to
+// send it, in which case it must call finish with the response.
+func (c *dedupCache) begin(key dedupKey) (*dedupEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := c.entries[key]; ok {
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			return entry, false
+		}
+		c.remove(entry)
+	}
+
+	for c.order.Len() >= c.maxEntries {
+		c.remove(c.order.Front().Value.(*dedupEntry))
+	}
+
+	entry := &dedupEntry{key: key, done: make(chan struct{})}
+	entry.elem = c.order.PushBack(entry)
+	c.entries[key] = entry
+	return entry, true
+}
+
+// finish records the response of the entry and wakes up the duplicates
+// waiting for it. Failures are not remembered so the notification can be
+// sent again.
+func (c *dedupCache) finish(entry *dedupEntry, resp PushResponse, status int) {
+	c.mu.Lock()
+	entry.resp = resp
+	entry.status = status
+	entry.expires = time.Now().Add(c.ttl)
+	if resp[PUSH_STATUS] == PUSH_STATUS_FAIL && c.entries[entry.key] == entry {
+		c.remove(entry)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+}
+
+func (c *dedupCache) remove(entry *dedupEntry) {
+	if c.entries[entry.key] == entry {
+		delete(c.entries, entry.key)
+	}
+	c.order.Remove(entry.elem)
+}
+
+// wait returns a copy of the response of the entry once available.
+func (entry *dedupEntry) wait(ctx context.Context) (PushResponse, int, bool) {
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return nil, 0, false
+	}
+	resp := make(PushResponse, len(entry.resp))
+	for k, v := range entry.resp {
+		resp[k] = v
+	}
+	return resp, entry.status, true
+}
+
+func (c *dedupCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
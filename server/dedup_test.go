@@ -0,0 +1,101 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupNotifications(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true, DedupTTLSeconds: 60}
+	msg := func(id, deviceID string) *PushNotification {
+		return &PushNotification{ID: id, Platform: "apple", ServerID: "sid", DeviceID: deviceID}
+	}
+
+	t.Run("duplicates get the first response", func(t *testing.T) {
+		srv := New(cfg, NewLogger(cfg))
+		target := &fakeNotificationServer{responses: []PushResponse{NewRemovePushResponse(), NewOkPushResponse()}}
+		srv.pushTargets["apple"] = target
+
+		resp, _ := srv.sendPushNotification(context.Background(), msg("id1", "did1"))
+		assert.Equal(t, PUSH_STATUS_REMOVE, resp[PUSH_STATUS])
+		resp, _ = srv.sendPushNotification(context.Background(), msg("id1", "did1"))
+		assert.Equal(t, PUSH_STATUS_REMOVE, resp[PUSH_STATUS])
+		assert.Equal(t, 1, target.count())
+
+		// Another device, another ID or no ID at all is sent.
+		srv.sendPushNotification(context.Background(), msg("id1", "did2"))
+		srv.sendPushNotification(context.Background(), msg("id2", "did1"))
+		srv.sendPushNotification(context.Background(), msg("", "did1"))
+		srv.sendPushNotification(context.Background(), msg("", "did1"))
+		assert.Equal(t, 5, target.count())
+	})
+
+	t.Run("failures are not remembered", func(t *testing.T) {
+		srv := New(cfg, NewLogger(cfg))
+		target := &fakeNotificationServer{responses: []PushResponse{NewErrorPushResponse("ServiceUnavailable"), NewOkPushResponse()}}
+		srv.pushTargets["apple"] = target
+
+		resp, _ := srv.sendPushNotification(context.Background(), msg("id1", "did1"))
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		resp, _ = srv.sendPushNotification(context.Background(), msg("id1", "did1"))
+		assert.Equal(t, PUSH_STATUS_OK, resp[PUSH_STATUS])
+		assert.Equal(t, 2, target.count())
+	})
+
+	t.Run("duplicates wait for the send in flight", func(t *testing.T) {
+		srv := New(cfg, NewLogger(cfg))
+		target := &fakeNotificationServer{release: make(chan struct{})}
+		srv.pushTargets["apple"] = target
+
+		var wg sync.WaitGroup
+		responses := make([]PushResponse, 3)
+		for i := range responses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				responses[i], _ = srv.sendPushNotification(context.Background(), msg("id1", "did1"))
+			}(i)
+		}
+		require.Eventually(t, func() bool { return srv.dedup.len() == 1 }, time.Second, 10*time.Millisecond)
+		close(target.release)
+		wg.Wait()
+
+		assert.Equal(t, 1, target.count())
+		for _, resp := range responses {
+			assert.Equal(t, PUSH_STATUS_OK, resp[PUSH_STATUS])
+		}
+	})
+}
+
+func TestDedupCache(t *testing.T) {
+	key := func(id string) dedupKey { return dedupKey{serverID: "sid", deviceID: "did", id: id} }
+
+	c := newDedupCache(50*time.Millisecond, 2)
+	for _, id := range []string{"a", "b", "c"} {
+		entry, first := c.begin(key(id))
+		require.True(t, first)
+		c.finish(entry, NewOkPushResponse(), 200)
+	}
+	assert.Equal(t, 2, c.len())
+
+	_, first := c.begin(key("a"))
+	assert.True(t, first, "oldest entry was evicted")
+	entry, first := c.begin(key("c"))
+	require.False(t, first)
+	resp, status, ok := entry.wait(context.Background())
+	require.True(t, ok)
+	assert.Equal(t, PUSH_STATUS_OK, resp[PUSH_STATUS])
+	assert.Equal(t, 200, status)
+
+	time.Sleep(60 * time.Millisecond)
+	_, first = c.begin(key("c"))
+	assert.True(t, first, "entry expired")
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDeliveryWorkers   = 4
+	defaultDeliveryQueueSize = 1000
+)
+
+type queuedNotification struct {
+	msg      *PushNotification
+	enqueued time.Time
+	seq      uint64
+}
+
+// deliveryQueue decouples accepting a notification from sending it. A fixed
+// pool of workers drains a bounded queue into the push target. When a
+// durable queue is set, notifications are persisted until delivered.
+type deliveryQueue struct {
+	pushType string
+	server   NotificationServer
+	workers  int
+	items    chan *queuedNotification
+	wal      *durableQueue
+	// deadLetters keeps the notifications aborted on shutdown when there is
+	// no durable queue.
+	deadLetters *deadLetterStore
+	metrics     *metrics
+	logger      *Logger
+
+	mu        sync.RWMutex
+	closed    bool
+	stopping  chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+	abandoned int32
+}
+
+func newDeliveryQueue(pushType string, server NotificationServer, settings DeliverySettings, wal *durableQueue, deadLetters *deadLetterStore, logger *Logger, metrics *metrics) *deliveryQueue {
+	workers := settings.Workers
+	if workers <= 0 {
+		workers = defaultDeliveryWorkers
+	}
+	queueSize := settings.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultDeliveryQueueSize
+	}
+
+	return &deliveryQueue{
+		pushType:    pushType,
+		server:      server,
+		workers:     workers,
+		items:       make(chan *queuedNotification, queueSize),
+		stopping:    make(chan struct{}),
+		wal:         wal,
+		deadLetters: deadLetters,
+		metrics:     metrics,
+		logger:      logger,
+	}
+}
+
+// start runs the workers. Cancelling ctx aborts the notifications being
+// sent; those persisted in the durable queue are replayed on the next start.
+func (q *deliveryQueue) start(ctx context.Context) {
+	q.logger.Infof("Starting %v delivery workers for type=%v queueSize=%v", q.workers, q.pushType, cap(q.items))
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker(ctx)
+	}
+}
+
+// enqueue adds msg to the queue without blocking. It returns false when the
+// queue is full or stopped.
+func (q *deliveryQueue) enqueue(msg *PushNotification) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed || len(q.items) == cap(q.items) {
+		return false
+	}
+
+	item := &queuedNotification{msg: msg, enqueued: time.Now()}
+	if q.wal != nil {
+		seq, err := q.wal.Add(q.pushType, msg)
+		if err != nil {
+			q.logger.Errorf("Failed to persist notification sid=%v did=%v type=%v err=%v", msg.ServerID, msg.DeviceID, q.pushType, err)
+			return false
+		}
+		item.seq = seq
+	}
+
+	select {
+	case q.items <- item:
+		if q.metrics != nil {
+			q.metrics.setQueueDepth(q.pushType, len(q.items))
+		}
+		return true
+	default:
+		q.markDone(item)
+		return false
+	}
+}
+
+// replay queues a notification read back from the durable queue, waiting
+// for room in the queue. It gives up when the queue is stopped; the
+// notification stays in the durable queue.
+func (q *deliveryQueue) replay(record *walRecord) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return false
+	}
+	select {
+	case q.items <- &queuedNotification{msg: record.Msg, enqueued: record.Accepted, seq: record.Seq}:
+	case <-q.stopping:
+		return false
+	}
+	if q.metrics != nil {
+		q.metrics.setQueueDepth(q.pushType, len(q.items))
+	}
+	return true
+}
+
+func (q *deliveryQueue) markDone(item *queuedNotification) {
+	if q.wal == nil || item.seq == 0 {
+		return
+	}
+	if err := q.wal.Done(item.seq); err != nil {
+		q.logger.Errorf("Failed to confirm persisted notification seq=%v type=%v err=%v", item.seq, q.pushType, err)
+	}
+}
+
+// stop refuses new notifications and waits for the workers to drain the
+// queue until ctx is done. It returns false when the queue was not drained in
+// time; the workers must then be aborted through their context.
+func (q *deliveryQueue) stop(ctx context.Context) bool {
+	// Release a replay waiting for room before taking the lock it holds.
+	q.stopOnce.Do(func() { close(q.stopping) })
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		q.logger.Errorf("Delivery queue type=%v not drained in time, %v notifications left", q.pushType, len(q.items))
+		return false
+	}
+}
+
+// wait blocks until the workers exited.
+func (q *deliveryQueue) wait() {
+	q.wg.Wait()
+	if abandoned := atomic.LoadInt32(&q.abandoned); abandoned > 0 {
+		q.logger.Errorf("Delivery queue type=%v stopped with %v notifications not delivered", q.pushType, abandoned)
+	}
+}
+
+// abandon sets aside a notification that could not be sent before shutdown.
+// Notifications in the durable queue are replayed on the next start; the
+// others are written to the dead-letter file, if any.
+func (q *deliveryQueue) abandon(item *queuedNotification) {
+	atomic.AddInt32(&q.abandoned, 1)
+	switch {
+	case q.wal != nil && item.seq != 0:
+		q.logger.Infof("Queued notification kept for replay sid=%v did=%v type=%v seq=%v", item.msg.ServerID, item.msg.DeviceID, q.pushType, item.seq)
+	case q.deadLetters != nil:
+		q.deadLetters.Add(&DeadLetter{
+			Time:     time.Now(),
+			Type:     q.pushType,
+			Reason:   "shutdown",
+			Response: NewErrorPushResponse("shutdown"),
+			Msg:      item.msg,
+		})
+	default:
+		q.logger.Errorf("Queued notification dropped on shutdown sid=%v did=%v type=%v", item.msg.ServerID, item.msg.DeviceID, q.pushType)
+	}
+}
+
+func (q *deliveryQueue) worker(ctx context.Context) {
+	defer q.wg.Done()
+
+	for item := range q.items {
+		if q.metrics != nil {
+			q.metrics.setQueueDepth(q.pushType, len(q.items))
+			q.metrics.observeQueueWait(q.pushType, time.Since(item.enqueued).Seconds())
+		}
+
+		if ctx.Err() != nil {
+			q.abandon(item)
+			continue
+		}
+
+		resp := q.server.SendNotification(ctx, item.msg)
+		if ctx.Err() != nil {
+			q.abandon(item)
+			continue
+		}
+		if resp[PUSH_STATUS] != PUSH_STATUS_OK {
+			q.logger.Errorf("Queued notification not delivered sid=%v did=%v type=%v resp=%v", item.msg.ServerID, item.msg.DeviceID, q.pushType, resp.ToJson())
+		}
+		q.markDone(item)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotificationServer records notifications and answers with canned
+// responses, optionally blocking until released.
+type fakeNotificationServer struct {
+	mu        sync.Mutex
+	sent      []*PushNotification
+	responses []PushResponse
+	release   chan struct{}
+}
+
+func (f *fakeNotificationServer) Initialize() bool { return true }
+
+func (f *fakeNotificationServer) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return NewErrorPushResponse("cancelled")
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, msg)
+	if len(f.responses) == 0 {
+		return NewOkPushResponse()
+	}
+	resp := f.responses[0]
+	if len(f.responses) > 1 {
+		f.responses = f.responses[1:]
+	}
+	return resp
+}
+
+func (f *fakeNotificationServer) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sent)
+}
+
+func TestDeliveryQueue(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true, EnableAsyncDelivery: true}
+	logger := NewLogger(cfg)
+	target := &fakeNotificationServer{release: make(chan struct{})}
+
+	srv := New(cfg, logger)
+	srv.pushTargets["android"] = target
+	queue := newDeliveryQueue("android", target, DeliverySettings{Workers: 1, QueueSize: 1}, nil, nil, logger, nil)
+	queue.start(context.Background())
+	srv.queues["android"] = queue
+
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"platform":"android","server_id":"server","device_id":"device"}`
+		srv.handleSendNotification(rec, httptest.NewRequest("POST", "/api/v1/send_push", strings.NewReader(body)))
+		return rec
+	}
+
+	// The first one is picked by the worker, the second one fills the queue.
+	rec := send()
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Equal(t, PUSH_STATUS_ACCEPTED, PushResponseFromJson(rec.Body)[PUSH_STATUS])
+	require.Eventually(t, func() bool { return len(queue.items) == 0 }, time.Second, time.Millisecond)
+	require.Equal(t, http.StatusAccepted, send().Code)
+
+	rec = send()
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, PUSH_STATUS_FAIL, PushResponseFromJson(rec.Body)[PUSH_STATUS])
+
+	close(target.release)
+	require.True(t, queue.stop(context.Background()))
+	require.Equal(t, 2, target.count())
+	require.False(t, queue.enqueue(&PushNotification{}))
+}
+
+func TestDeliveryQueueDrainDeadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "deadletters.jsonl")
+
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	target := &fakeNotificationServer{release: make(chan struct{})}
+	queue := newDeliveryQueue("android", target, DeliverySettings{Workers: 1, QueueSize: 5}, nil, newDeadLetterStore(fileName, logger), logger, nil)
+	workerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue.start(workerCtx)
+
+	for i := 0; i < 3; i++ {
+		require.True(t, queue.enqueue(&PushNotification{ServerID: "server", DeviceID: "device"}))
+	}
+
+	ctx, stopCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer stopCancel()
+	require.False(t, queue.stop(ctx))
+
+	cancel()
+	queue.wait()
+
+	letters, _, err := ReadDeadLetters(fileName)
+	require.NoError(t, err)
+	require.Len(t, letters, 3)
+	require.Equal(t, "shutdown", letters[0].Reason)
+	require.Equal(t, "android", letters[0].Type)
+}
+
+func TestSyncSendAbortedByStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "deadletters.jsonl")
+
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	srv := New(cfg, logger)
+	srv.deadLetters = newDeadLetterStore(fileName, logger)
+	target := &fakeNotificationServer{release: make(chan struct{})}
+	srv.pushTargets[PushNotifyAndroid] = newRetryNotificationServer(PushNotifyAndroid, target, RetrySettings{}, srv.deadLetters, logger, nil)
+
+	// A request the client gave up on is not kept.
+	ctx, cancel := context.WithCancel(srv.ctx)
+	cancel()
+	msg := &PushNotification{ServerID: "server", DeviceID: "device", Platform: PushNotifyAndroid}
+	resp, _ := srv.deliverPushNotification(ctx, msg)
+	require.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+	letters, _, err := ReadDeadLetters(fileName)
+	require.NoError(t, err)
+	require.Empty(t, letters)
+
+	ctx, cancel = context.WithCancel(srv.ctx)
+	defer cancel()
+	srv.cancel()
+	resp, _ = srv.deliverPushNotification(ctx, msg)
+	require.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+	letters, _, err = ReadDeadLetters(fileName)
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	require.Equal(t, "shutdown", letters[0].Reason)
+	require.Equal(t, PushNotifyAndroid, letters[0].Type)
+}
+
+// hangingNotificationServer waits for the send to be aborted, then takes a
+// while to give up.
+type hangingNotificationServer struct {
+	started chan struct{}
+}
+
+func (h *hangingNotificationServer) Initialize() bool { return true }
+
+func (h *hangingNotificationServer) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
+	close(h.started)
+	<-ctx.Done()
+	time.Sleep(100 * time.Millisecond)
+	return NewErrorPushResponse("cancelled")
+}
+
+func TestStopWaitsForSyncSends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "deadletters.jsonl")
+
+	cfg := &ConfigPushProxy{EnableConsoleLog: true, DrainTimeoutSeconds: 1}
+	logger := NewLogger(cfg)
+	srv := New(cfg, logger)
+	srv.deadLetters = newDeadLetterStore(fileName, logger)
+	target := &hangingNotificationServer{started: make(chan struct{})}
+	srv.pushTargets[PushNotifyAndroid] = target
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv.httpServer = &http.Server{
+		Handler:     srv.trackSends(srv.handleSendNotification),
+		BaseContext: func(net.Listener) context.Context { return srv.ctx },
+	}
+	go func() { _ = srv.httpServer.Serve(ln) }()
+
+	go func() {
+		body := `{"platform":"android","server_id":"server","device_id":"device"}`
+		resp, err := http.Post("http://"+ln.Addr().String()+"/api/v1/send_push", "application/json", strings.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-target.started
+	srv.Stop()
+
+	letters, _, err := ReadDeadLetters(fileName)
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	require.Equal(t, "shutdown", letters[0].Reason)
+}
+
+func TestDeliveryQueueStopDuringReplay(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	queue := newDeliveryQueue("android", &fakeNotificationServer{}, DeliverySettings{Workers: 1, QueueSize: 1}, nil, nil, logger, nil)
+
+	// No worker drains the queue, so the second replay waits for room.
+	require.True(t, queue.replay(&walRecord{Seq: 1, Msg: &PushNotification{}}))
+	replayed := make(chan bool)
+	go func() {
+		replayed <- queue.replay(&walRecord{Seq: 2, Msg: &PushNotification{}})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.True(t, queue.stop(ctx))
+	require.False(t, <-replayed)
+}
+
+func TestReadiness(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	srv := New(cfg, NewLogger(cfg))
+
+	rec := httptest.NewRecorder()
+	srv.handleReady(rec, httptest.NewRequest("GET", "/ready", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	atomic.StoreInt32(&srv.draining, 1)
+	rec = httptest.NewRecorder()
+	srv.handleReady(rec, httptest.NewRequest("GET", "/ready", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	durableQueueFile = "queue.wal"
+
+	walOpAdd  = "add"
+	walOpDone = "done"
+
+	defaultQueueCompactInterval = 5 * time.Minute
+)
+
+type walRecord struct {
+	Op       string            `json:"op"`
+	Seq      uint64            `json:"seq"`
+	Type     string            `json:"type,omitempty"`
+	Accepted time.Time         `json:"accepted,omitempty"`
+	Msg      *PushNotification `json:"msg,omitempty"`
+}
+
+// durableQueue is a write-ahead log of accepted notifications. An entry is
+// appended when a notification is accepted and marked done once a provider
+// answered for it, so that pending entries can be replayed after a restart.
+// The log is periodically rewritten with only the pending entries.
+type durableQueue struct {
+	path   string
+	logger *Logger
+
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	seq     uint64
+	pending map[uint64]*walRecord
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newDurableQueue(dir string, logger *Logger) (*durableQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &durableQueue{
+		path:    filepath.Join(dir, durableQueueFile),
+		logger:  logger,
+		pending: make(map[uint64]*walRecord),
+		done:    make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads the log back into memory. A truncated last record, left by a
+// crash in the middle of a write, is ignored.
+func (q *durableQueue) load() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			q.logger.Errorf("Skipping corrupted queue record in %v err=%v", q.path, err)
+			continue
+		}
+		if record.Seq > q.seq {
+			q.seq = record.Seq
+		}
+		switch record.Op {
+		case walOpAdd:
+			r := record
+			q.pending[record.Seq] = &r
+		case walOpDone:
+			delete(q.pending, record.Seq)
+		}
+	}
+	return scanner.Err()
+}
+
+// Pending returns the entries not confirmed yet, oldest first.
+func (q *durableQueue) Pending() []*walRecord {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	records := make([]*walRecord, 0, len(q.pending))
+	for _, record := range q.pending {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	return records
+}
+
+// Add persists msg for the given push target and returns its sequence
+// number.
+func (q *durableQueue) Add(pushType string, msg *PushNotification) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	record := &walRecord{Op: walOpAdd, Seq: q.seq, Type: pushType, Accepted: time.Now(), Msg: msg}
+	if err := q.append(record); err != nil {
+		return 0, err
+	}
+	q.pending[record.Seq] = record
+	return record.Seq, nil
+}
+
+// Done marks the entry as confirmed.
+func (q *durableQueue) Done(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.pending[seq]; !ok {
+		return nil
+	}
+	delete(q.pending, seq)
+	return q.append(&walRecord{Op: walOpDone, Seq: seq})
+}
+
+// append writes and syncs one record. It must be called with the lock held.
+func (q *durableQueue) append(record *walRecord) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = q.writer.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	if err = q.writer.Flush(); err != nil {
+		return err
+	}
+	return q.file.Sync()
+}
+
+// compact atomically replaces the log with the pending entries only.
+func (q *durableQueue) compact() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(q.path), durableQueueFile+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	writer := bufio.NewWriter(f)
+	encoder := json.NewEncoder(writer)
+	for _, record := range q.pending {
+		if err = encoder.Encode(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = os.Rename(f.Name(), q.path); err != nil {
+		f.Close()
+		return err
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = f
+	q.writer = bufio.NewWriter(f)
+	return nil
+}
+
+// startCompaction compacts the log every interval until close is called.
+func (q *durableQueue) startCompaction(interval time.Duration) {
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := q.compact(); err != nil {
+					q.logger.Errorf("Failed to compact the delivery queue log err=%v", err)
+				}
+			case <-q.done:
+				return
+			}
+		}
+	}()
+}
+
+func (q *durableQueue) close() error {
+	close(q.done)
+	q.wg.Wait()
+
+	if err := q.compact(); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurableQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logger := NewLogger(&ConfigPushProxy{EnableConsoleLog: true})
+
+	wal, err := newDurableQueue(dir, logger)
+	require.NoError(t, err)
+	first, err := wal.Add("apple", &PushNotification{DeviceID: "first", Type: PushTypeClear})
+	require.NoError(t, err)
+	second, err := wal.Add("android", &PushNotification{DeviceID: "second", Type: PushTypeSession})
+	require.NoError(t, err)
+	require.NoError(t, wal.Done(first))
+
+	// Simulate a crash: nothing is compacted and the last write is torn.
+	f, err := os.OpenFile(filepath.Join(dir, durableQueueFile), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"add","seq":`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	wal, err = newDurableQueue(dir, logger)
+	require.NoError(t, err)
+	pending := wal.Pending()
+	require.Len(t, pending, 1)
+	require.Equal(t, second, pending[0].Seq)
+	require.Equal(t, "android", pending[0].Type)
+	require.Equal(t, "second", pending[0].Msg.DeviceID)
+
+	// Sequence numbers keep growing after a restart.
+	third, err := wal.Add("android", &PushNotification{DeviceID: "third"})
+	require.NoError(t, err)
+	require.True(t, third > second)
+	require.NoError(t, wal.Done(second))
+	require.NoError(t, wal.close())
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, durableQueueFile))
+	require.NoError(t, err)
+	require.Contains(t, string(buf), `"third"`)
+	require.NotContains(t, string(buf), `"second"`, "compaction should drop confirmed entries")
+}
+
+func TestDeliveryQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	wal, err := newDurableQueue(dir, logger)
+	require.NoError(t, err)
+	_, err = wal.Add("android", &PushNotification{DeviceID: "pending"})
+	require.NoError(t, err)
+	_, err = wal.Add("junk", &PushNotification{DeviceID: "orphan"})
+	require.NoError(t, err)
+
+	target := &fakeNotificationServer{}
+	srv := New(cfg, logger)
+	srv.wal = wal
+	queue := newDeliveryQueue("android", target, DeliverySettings{}, wal, nil, logger, nil)
+	queue.start(context.Background())
+	srv.queues["android"] = queue
+
+	srv.replayPendingNotifications()
+	require.True(t, queue.enqueue(&PushNotification{DeviceID: "new"}))
+	require.True(t, queue.stop(context.Background()))
+
+	require.Equal(t, 2, target.count())
+	require.ElementsMatch(t, []string{"pending", "new"}, []string{target.sent[0].DeviceID, target.sent[1].DeviceID})
+	pending := wal.Pending()
+	require.Len(t, pending, 1, "entries without a push target stay pending")
+	require.Equal(t, "orphan", pending[0].Msg.DeviceID)
+	require.True(t, pending[0].Accepted.Before(time.Now()))
+	require.NoError(t, wal.close())
+}
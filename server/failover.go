@@ -0,0 +1,81 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"fmt"
+)
+
+const PUSH_BACKEND = "backend"
+
+// deviceResolver is implemented by push targets whose device IDs differ from
+// the ones the Mattermost server sends. resolveDeviceID returns the ID to use
+// with the target, or false when the device cannot be reached through it.
+type deviceResolver interface {
+	resolveDeviceID(deviceID string) (string, bool)
+}
+
+// wrappedNotificationServer is implemented by the servers decorating a push
+// target, such as retries and circuit breakers.
+type wrappedNotificationServer interface {
+	unwrap() NotificationServer
+}
+
+// resolveDeviceID asks the push target behind server how to address
+// deviceID. Targets not implementing deviceResolver use it as is.
+func resolveDeviceID(server NotificationServer, deviceID string) (string, bool) {
+	for {
+		if resolver, ok := server.(deviceResolver); ok {
+			return resolver.resolveDeviceID(deviceID)
+		}
+		wrapped, ok := server.(wrappedNotificationServer)
+		if !ok {
+			return deviceID, true
+		}
+		server = wrapped.unwrap()
+	}
+}
+
+type failoverBackend struct {
+	pushType string
+	server   NotificationServer
+}
+
+// failoverNotificationServer sends a notification to the first of its
+// backends, moving to the next one when it fails or cannot reach the
+// device. REMOVE is final: the device is gone, whatever the backend.
+type failoverNotificationServer struct {
+	pushType string
+	backends []failoverBackend
+	logger   *Logger
+}
+
+func (fs *failoverNotificationServer) Initialize() bool {
+	return true
+}
+
+func (fs *failoverNotificationServer) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
+	resp := NewErrorPushResponse(fmt.Sprintf("no backend can reach the device type=%v", fs.pushType))
+	for _, backend := range fs.backends {
+		deviceID, ok := resolveDeviceID(backend.server, msg.DeviceID)
+		if !ok {
+			continue
+		}
+
+		backendMsg := *msg
+		backendMsg.DeviceID = deviceID
+		resp = backend.server.SendNotification(ctx, &backendMsg)
+		if resp[PUSH_STATUS] != PUSH_STATUS_FAIL {
+			resp[PUSH_BACKEND] = backend.pushType
+			return resp
+		}
+		if ctx.Err() != nil {
+			return resp
+		}
+
+		fs.logger.Errorf("Push failed on backend=%v sid=%v did=%v type=%v err=%v", backend.pushType, msg.ServerID, msg.DeviceID, fs.pushType, resp[PUSH_STATUS_ERROR_MSG])
+	}
+	return resp
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type resolvingNotificationServer struct {
+	fakeNotificationServer
+	devices map[string]string
+}
+
+func (r *resolvingNotificationServer) resolveDeviceID(deviceID string) (string, bool) {
+	id, ok := r.devices[deviceID]
+	return id, ok
+}
+
+func TestFailoverNotificationServer(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	msg := &PushNotification{ServerID: "sid", DeviceID: "did"}
+
+	t.Run("falls back on FAIL", func(t *testing.T) {
+		primary := &fakeNotificationServer{responses: []PushResponse{NewErrorPushResponse("invalid response")}}
+		secondary := &fakeNotificationServer{}
+		fs := &failoverNotificationServer{pushType: "android_cn", logger: logger, backends: []failoverBackend{
+			{pushType: "android_cn_jpush", server: primary},
+			{pushType: "android_cn_wechat", server: secondary},
+		}}
+
+		resp := fs.SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_OK, resp[PUSH_STATUS])
+		assert.Equal(t, "android_cn_wechat", resp[PUSH_BACKEND])
+		assert.Equal(t, 1, primary.count())
+		assert.Equal(t, 1, secondary.count())
+	})
+
+	t.Run("stops on REMOVE", func(t *testing.T) {
+		primary := &fakeNotificationServer{responses: []PushResponse{NewRemovePushResponse()}}
+		secondary := &fakeNotificationServer{}
+		fs := &failoverNotificationServer{pushType: "android_cn", logger: logger, backends: []failoverBackend{
+			{pushType: "android_cn_jpush", server: primary},
+			{pushType: "android_cn_wechat", server: secondary},
+		}}
+
+		resp := fs.SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_REMOVE, resp[PUSH_STATUS])
+		assert.Equal(t, "android_cn_jpush", resp[PUSH_BACKEND])
+		assert.Equal(t, 0, secondary.count())
+	})
+
+	t.Run("falls back when the circuit is open", func(t *testing.T) {
+		primary := &fakeNotificationServer{responses: []PushResponse{NewTransientErrorPushResponse("unknown transport error", 0)}}
+		breaker := newCircuitBreaker("android_cn_jpush", primary, CircuitBreakerSettings{ConsecutiveFailures: 1}, logger, nil)
+		breaker.SendNotification(context.Background(), msg)
+		require.Equal(t, CircuitOpen, breaker.State())
+
+		secondary := &fakeNotificationServer{}
+		fs := &failoverNotificationServer{pushType: "android_cn", logger: logger, backends: []failoverBackend{
+			{pushType: "android_cn_jpush", server: breaker},
+			{pushType: "android_cn_wechat", server: secondary},
+		}}
+
+		resp := fs.SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_OK, resp[PUSH_STATUS])
+		assert.Equal(t, "android_cn_wechat", resp[PUSH_BACKEND])
+		assert.Equal(t, 1, primary.count())
+	})
+
+	t.Run("resolves device IDs per backend", func(t *testing.T) {
+		primary := &resolvingNotificationServer{devices: map[string]string{}}
+		secondary := &resolvingNotificationServer{devices: map[string]string{"did": "openid"}}
+		wrapped := newRetryNotificationServer("android_cn_wechat", secondary, RetrySettings{}, nil, logger, nil)
+		fs := &failoverNotificationServer{pushType: "android_cn", logger: logger, backends: []failoverBackend{
+			{pushType: "android_cn_jpush", server: primary},
+			{pushType: "android_cn_wechat", server: wrapped},
+		}}
+
+		resp := fs.SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_OK, resp[PUSH_STATUS])
+		assert.Equal(t, 0, primary.count())
+		require.Equal(t, 1, secondary.count())
+		assert.Equal(t, "openid", secondary.sent[0].DeviceID)
+		assert.Equal(t, "did", msg.DeviceID)
+	})
+
+	t.Run("fails when every backend fails", func(t *testing.T) {
+		fs := &failoverNotificationServer{pushType: "android_cn", logger: logger, backends: []failoverBackend{
+			{pushType: "android_cn_jpush", server: &fakeNotificationServer{responses: []PushResponse{NewErrorPushResponse("first")}}},
+			{pushType: "android_cn_wechat", server: &fakeNotificationServer{responses: []PushResponse{NewErrorPushResponse("second")}}},
+		}}
+
+		resp := fs.SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, "second", resp[PUSH_STATUS_ERROR_MSG])
+	})
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	tcpKeepAlive          = 30 * time.Second
+)
+
+func (d *DeliverySettings) connectTimeout() time.Duration {
+	if d.ConnectTimeoutMs > 0 {
+		return time.Duration(d.ConnectTimeoutMs) * time.Millisecond
+	}
+	return defaultConnectTimeout
+}
+
+func (d *DeliverySettings) requestTimeout() time.Duration {
+	if d.RequestTimeoutMs > 0 {
+		return time.Duration(d.RequestTimeoutMs) * time.Millisecond
+	}
+	return time.Duration(CONNECTION_TIMEOUT_SECONDS) * time.Second
+}
+
+func (d *DeliverySettings) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: d.connectTimeout(), KeepAlive: tcpKeepAlive}
+}
+
+// newHTTPClient returns a client for calling a provider API with the
+// timeouts of the push target.
+func newHTTPClient(settings DeliverySettings) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = settings.dialer().DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   settings.requestTimeout(),
+	}
+}
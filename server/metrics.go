@@ -20,6 +20,12 @@ const (
 	metricAPNSResponseName         = "service_apns_request_duration_seconds"
 	metricServiceResponseName      = "service_request_duration_seconds"
 	metricNotificationResponseName = "service_notification_duration_seconds"
+	metricQueueDepthName           = "service_queue_depth"
+	metricQueueWaitName            = "service_queue_wait_seconds"
+	metricRetriesName              = "service_retries_total"
+	metricCircuitBreakerStateName  = "service_circuit_breaker_state"
+	metricDedupHitsName            = "service_dedup_hits_total"
+	metricAuthFailuresName         = "service_auth_failures_total"
 )
 
 // NewPrometheusHandler returns the http.Handler to expose Prometheus metrics
@@ -40,6 +46,12 @@ type metrics struct {
 	metricFCMResponse          prometheus.Histogram
 	metricNotificationResponse *prometheus.HistogramVec
 	metricServiceResponse      prometheus.Histogram
+	metricQueueDepth           *prometheus.GaugeVec
+	metricQueueWait            *prometheus.HistogramVec
+	metricRetries              *prometheus.CounterVec
+	metricCircuitBreakerState  *prometheus.GaugeVec
+	metricDedupHits            *prometheus.CounterVec
+	metricAuthFailures         *prometheus.CounterVec
 }
 
 // newMetrics initializes the metrics and registers them
@@ -95,6 +107,30 @@ func newMetrics() *metrics {
 			Name: metricServiceResponseName,
 			Help: "Request latency distribution",
 		}),
+		metricQueueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: metricQueueDepthName,
+			Help: "Number of notifications waiting in the delivery queue"},
+			[]string{"type"}),
+		metricQueueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: metricQueueWaitName,
+			Help: "Time notifications spent in the delivery queue"},
+			[]string{"type"}),
+		metricRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: metricRetriesName,
+			Help: "Number of push retries after a transient failure"},
+			[]string{"type"}),
+		metricCircuitBreakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: metricCircuitBreakerStateName,
+			Help: "State of the push target circuit breaker, 0 closed, 1 half-open, 2 open"},
+			[]string{"type"}),
+		metricDedupHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: metricDedupHitsName,
+			Help: "Number of duplicate notifications answered from the dedup cache"},
+			[]string{"platform"}),
+		metricAuthFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: metricAuthFailuresName,
+			Help: "Number of send requests rejected by server authentication"},
+			[]string{"reason"}),
 	}
 
 	prometheus.MustRegister(
@@ -109,6 +145,12 @@ func newMetrics() *metrics {
 		m.metricFCMResponse,
 		m.metricServiceResponse,
 		m.metricNotificationResponse,
+		m.metricQueueDepth,
+		m.metricQueueWait,
+		m.metricRetries,
+		m.metricCircuitBreakerState,
+		m.metricDedupHits,
+		m.metricAuthFailures,
 	)
 
 	return m
@@ -131,6 +173,12 @@ func (m *metrics) shutdown() {
 		m.metricFCMResponse,
 		m.metricServiceResponse,
 		m.metricNotificationResponse,
+		m.metricQueueDepth,
+		m.metricQueueWait,
+		m.metricRetries,
+		m.metricCircuitBreakerState,
+		m.metricDedupHits,
+		m.metricAuthFailures,
 	)
 }
 
@@ -188,3 +236,27 @@ func (m *metrics) observerNotificationResponse(platform string, dur float64) {
 		m.observeFCMResponse(dur)
 	}
 }
+
+func (m *metrics) setQueueDepth(pushType string, depth int) {
+	m.metricQueueDepth.WithLabelValues(pushType).Set(float64(depth))
+}
+
+func (m *metrics) observeQueueWait(pushType string, dur float64) {
+	m.metricQueueWait.WithLabelValues(pushType).Observe(dur)
+}
+
+func (m *metrics) incrementRetry(pushType string) {
+	m.metricRetries.WithLabelValues(pushType).Inc()
+}
+
+func (m *metrics) setCircuitBreakerState(pushType string, state float64) {
+	m.metricCircuitBreakerState.WithLabelValues(pushType).Set(state)
+}
+
+func (m *metrics) incrementDedupHit(platform string) {
+	m.metricDedupHits.WithLabelValues(platform).Inc()
+}
+
+func (m *metrics) incrementAuthFailure(reason string) {
+	m.metricAuthFailures.WithLabelValues(reason).Inc()
+}
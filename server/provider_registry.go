@@ -0,0 +1,120 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	ProviderAPNS = "apns"
+)
+
+// PushTarget is what a ProviderFactory receives to build a NotificationServer.
+// Settings holds the provider specific configuration block untouched.
+type PushTarget struct {
+	PushTargetSettings
+	Logger  *Logger
+	metrics *metrics
+}
+
+// ProviderFactory builds a NotificationServer for a push target.
+type ProviderFactory func(target *PushTarget) (NotificationServer, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]ProviderFactory)
+)
+
+func init() {
+	RegisterProvider(ProviderAPNS, func(target *PushTarget) (NotificationServer, error) {
+		var settings ApplePushSettings
+		if err := target.decodeSettings(&settings); err != nil {
+			return nil, err
+		}
+		settings.Type = target.Type
+		return NewAppleNotificationServer(settings, target.Logger, target.metrics), nil
+	})
+	RegisterProvider(AndroidProviderFCM, androidProviderFactory(NewAndroidNotificationServer))
+	RegisterProvider(AndroidProviderFCMv1, androidProviderFactory(NewAndroidNotificationServerV1))
+	RegisterProvider(AndroidProviderJPush, androidProviderFactory(NewAndroidNotificationServerJ))
+	RegisterProvider(AndroidProviderWechat, androidProviderFactory(NewAndroidNotificationServerW))
+}
+
+// RegisterProvider makes a NotificationServer implementation available under
+// the given name, so it can be referenced by the Provider field of a push
+// target. It panics if the name is empty, already registered or the factory
+// is nil, as this is meant to be called from init functions.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if name == "" {
+		panic("push proxy: RegisterProvider name is empty")
+	}
+	if factory == nil {
+		panic("push proxy: RegisterProvider factory is nil for " + name)
+	}
+	if _, dup := providers[name]; dup {
+		panic("push proxy: RegisterProvider called twice for " + name)
+	}
+	providers[name] = factory
+}
+
+// unregisterProvider removes a provider, for tests registering their own.
+func unregisterProvider(name string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	delete(providers, name)
+}
+
+// Providers returns the sorted names of the registered providers.
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newProviderServer(target *PushTarget) (NotificationServer, error) {
+	providersMu.RLock()
+	factory, ok := providers[target.Provider]
+	providersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q for type=%v", target.Provider, target.Type)
+	}
+	return factory(target)
+}
+
+// decodeSettings unmarshals the provider specific settings block into v.
+func (t *PushTarget) decodeSettings(v interface{}) error {
+	if len(t.Settings) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(t.Settings, v); err != nil {
+		return fmt.Errorf("invalid settings for provider %q type=%v: %v", t.Provider, t.Type, err)
+	}
+	return nil
+}
+
+func androidProviderFactory(newServer func(AndroidPushSettings, *Logger, *metrics) NotificationServer) ProviderFactory {
+	return func(target *PushTarget) (NotificationServer, error) {
+		var settings AndroidPushSettings
+		if err := target.decodeSettings(&settings); err != nil {
+			return nil, err
+		}
+		settings.Type = target.Type
+		settings.Provider = target.Provider
+		return newServer(settings, target.Logger, target.metrics), nil
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyProtocolHeaderTimeout = 5 * time.Second
+	proxyProtocolV1MaxLength   = 107
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener reads the HAProxy PROXY protocol header, version 1
+// or 2, that TCP load balancers send first on every connection, and reports
+// the client address it carries as the remote address of the connection.
+// Only the connections of trusted proxies are expected to start with a
+// header, so that other clients cannot choose their address.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted trustedProxies
+	logger  *Logger
+}
+
+func newProxyProtocolListener(ln net.Listener, trusted trustedProxies, logger *Logger) net.Listener {
+	return &proxyProtocolListener{Listener: ln, trusted: trusted, logger: logger}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !l.trusted.contains(addr.IP) {
+		return conn, nil
+	}
+	// The header is read on first use, from the goroutine serving the
+	// connection, so a slow client does not hold up Accept.
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), logger: l.logger}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	logger *Logger
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		c.remote, c.err = readProxyProtocolHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.logger.Errorf("Invalid PROXY protocol header from %v err=%v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader consumes a version 1 or 2 header. It returns a
+// nil address for headers that carry none, such as health checks of the
+// load balancer itself.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return readProxyProtocolV1(r)
+	}
+	return nil, fmt.Errorf("missing PROXY protocol header")
+}
+
+// readProxyProtocolV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n".
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, fmt.Errorf("PROXY v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source %v:%v", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 parses the binary header: the signature, the version
+// and command, the address family, the length of the addresses and then the
+// addresses themselves.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %v", versionCommand>>4)
+	}
+	switch versionCommand & 0x0f {
+	case 0x0:
+		// LOCAL: the load balancer talking for itself.
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %v", versionCommand&0x0f)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// UDP and unix sockets carry no usable client address.
+	return nil, nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyProtocolV2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	logger := NewLogger(&ConfigPushProxy{EnableConsoleLog: true})
+
+	ipv4 := []byte{1, 2, 3, 4, 10, 0, 0, 1, 0x13, 0x88, 0x1f, 0x90}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ipv6[32:34], 5000)
+
+	local := []string{"127.0.0.1"}
+	for name, tc := range map[string]struct {
+		trusted  []string
+		header   []byte
+		expected string
+		fails    bool
+	}{
+		"v1 ipv4":            {local, []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5000 8080\r\n"), "1.2.3.4:5000", false},
+		"v1 ipv6":            {local, []byte("PROXY TCP6 2001:db8::1 ::1 5000 8080\r\n"), "[2001:db8::1]:5000", false},
+		"v1 unknown":         {local, []byte("PROXY UNKNOWN\r\n"), "", false},
+		"v2 ipv4":            {local, proxyProtocolV2Header(0x1, 0x11, ipv4), "1.2.3.4:5000", false},
+		"v2 ipv6":            {local, proxyProtocolV2Header(0x1, 0x21, ipv6), "[2001:db8::1]:5000", false},
+		"v2 local":           {local, proxyProtocolV2Header(0x0, 0x00, nil), "", false},
+		"missing header":     {local, []byte("GET / HTTP/1.1\r\n"), "", true},
+		"malformed v1":       {local, []byte("PROXY TCP4 junk\r\n"), "", true},
+		"untrusted peer":     {[]string{"10.0.0.0/8"}, []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5000 8080\r\n"), "", false},
+		"v2 short addresses": {local, proxyProtocolV2Header(0x1, 0x11, ipv4[:4]), "", true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			trusted, err := newTrustedProxies(tc.trusted)
+			require.NoError(t, err)
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			ln := newProxyProtocolListener(inner, trusted, logger)
+			defer ln.Close()
+
+			go func() {
+				client, err := net.Dial("tcp", inner.Addr().String())
+				if err != nil {
+					return
+				}
+				defer client.Close()
+				_, _ = client.Write(append(tc.header, []byte("payload")...))
+			}()
+
+			conn, err := ln.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+
+			data, err := ioutil.ReadAll(conn)
+			if tc.fails {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			switch {
+			case name == "untrusted peer":
+				// Connections from untrusted peers are passed through as is.
+				assert.Equal(t, string(tc.header)+"payload", string(data))
+			case tc.expected == "":
+				assert.Equal(t, "payload", string(data))
+				assert.Equal(t, inner.Addr().(*net.TCPAddr).IP.String(), conn.RemoteAddr().(*net.TCPAddr).IP.String())
+			default:
+				assert.Equal(t, "payload", string(data))
+				assert.Equal(t, tc.expected, conn.RemoteAddr().String())
+			}
+		})
+	}
+}
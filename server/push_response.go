@@ -6,6 +6,8 @@ package server
 import (
 	"encoding/json"
 	"io"
+	"strconv"
+	"time"
 )
 
 const (
@@ -13,7 +15,10 @@ const (
 	PUSH_STATUS_OK        = "OK"
 	PUSH_STATUS_FAIL      = "FAIL"
 	PUSH_STATUS_REMOVE    = "REMOVE"
+	PUSH_STATUS_ACCEPTED  = "ACCEPTED"
 	PUSH_STATUS_ERROR_MSG = "error"
+	PUSH_RETRYABLE        = "retryable"
+	PUSH_RETRY_AFTER      = "retry_after"
 )
 
 type PushResponse map[string]string
@@ -30,6 +35,14 @@ func NewRemovePushResponse() PushResponse {
 	return m
 }
 
+// NewAcceptedPushResponse is returned when a notification was queued for
+// asynchronous delivery.
+func NewAcceptedPushResponse() PushResponse {
+	m := make(map[string]string)
+	m[PUSH_STATUS] = PUSH_STATUS_ACCEPTED
+	return m
+}
+
 func NewErrorPushResponse(message string) PushResponse {
 	m := make(map[string]string)
 	m[PUSH_STATUS] = PUSH_STATUS_FAIL
@@ -37,6 +50,39 @@ func NewErrorPushResponse(message string) PushResponse {
 	return m
 }
 
+// NewTransientErrorPushResponse is returned for failures that may succeed
+// when retried, such as transport errors or a provider being overloaded.
+// retryAfter is the delay asked by the provider, if any.
+func NewTransientErrorPushResponse(message string, retryAfter time.Duration) PushResponse {
+	m := NewErrorPushResponse(message)
+	m[PUSH_RETRYABLE] = "true"
+	if retryAfter > 0 {
+		m[PUSH_RETRY_AFTER] = strconv.Itoa(int(retryAfter.Seconds()))
+	}
+	return m
+}
+
+func (me PushResponse) retryable() bool {
+	return me[PUSH_STATUS] == PUSH_STATUS_FAIL && me[PUSH_RETRYABLE] == "true"
+}
+
+func (me PushResponse) retryAfter() time.Duration {
+	seconds, _ := strconv.Atoi(me[PUSH_RETRY_AFTER])
+	return time.Duration(seconds) * time.Second
+}
+
+// MarshalJSON leaves out the retry hints, which are only meant for the
+// delivery pipeline of the proxy and not for Mattermost.
+func (me PushResponse) MarshalJSON() ([]byte, error) {
+	m := make(map[string]string, len(me))
+	for k, v := range me {
+		if k != PUSH_RETRYABLE && k != PUSH_RETRY_AFTER {
+			m[k] = v
+		}
+	}
+	return json.Marshal(m)
+}
+
 func (me *PushResponse) ToJson() string {
 	if b, err := json.Marshal(me); err != nil {
 		return ""
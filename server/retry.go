@@ -0,0 +1,334 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	HEADER_RETRY_AFTER = "Retry-After"
+
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseBackoff = 200 * time.Millisecond
+	defaultRetryMaxBackoff  = 5 * time.Second
+	defaultRetryJitter      = 0.2
+)
+
+type retryPolicy struct {
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	jitter      float64
+}
+
+func newRetryPolicy(settings RetrySettings) *retryPolicy {
+	p := &retryPolicy{
+		maxAttempts: settings.MaxAttempts,
+		baseBackoff: time.Duration(settings.BaseBackoffMs) * time.Millisecond,
+		maxBackoff:  time.Duration(settings.MaxBackoffMs) * time.Millisecond,
+		jitter:      settings.Jitter,
+	}
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = defaultRetryMaxAttempts
+	}
+	if p.baseBackoff <= 0 {
+		p.baseBackoff = defaultRetryBaseBackoff
+	}
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = defaultRetryMaxBackoff
+	}
+	if p.jitter <= 0 || p.jitter > 1 {
+		p.jitter = defaultRetryJitter
+	}
+	return p
+}
+
+// backoff returns how long to wait before the given retry, starting at 1. The
+// second value is false when the provider asked to wait longer than the
+// maximum backoff, in which case retrying is pointless.
+func (p *retryPolicy) backoff(retry int, retryAfter time.Duration) (time.Duration, bool) {
+	if retryAfter > p.maxBackoff {
+		return 0, false
+	}
+
+	d := p.baseBackoff << uint(retry-1)
+	if d <= 0 || d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	d += time.Duration((rand.Float64()*2 - 1) * p.jitter * float64(d))
+	if d < retryAfter {
+		d = retryAfter
+	}
+	return d, true
+}
+
+// retryNotificationServer retries transient failures of the wrapped push
+// target. REMOVE and permanent FAIL responses are returned right away.
+// Notifications that still fail are written to the dead-letter store, if any.
+type retryNotificationServer struct {
+	NotificationServer
+	pushType    string
+	policy      *retryPolicy
+	deadLetters *deadLetterStore
+	metrics     *metrics
+	logger      *Logger
+}
+
+func newRetryNotificationServer(pushType string, server NotificationServer, settings RetrySettings, deadLetters *deadLetterStore, logger *Logger, metrics *metrics) *retryNotificationServer {
+	return &retryNotificationServer{
+		NotificationServer: server,
+		pushType:           pushType,
+		policy:             newRetryPolicy(settings),
+		deadLetters:        deadLetters,
+		metrics:            metrics,
+		logger:             logger,
+	}
+}
+
+func (rs *retryNotificationServer) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
+	resp, attempts := rs.send(ctx, msg)
+	rs.deadLetter(ctx, msg, resp, attempts)
+	return resp
+}
+
+// sendMulticast retries the devices of a multicast that failed with a
+// transient error, together.
+func (rs *retryNotificationServer) sendMulticast(ctx context.Context, msgs []*PushNotification) []PushResponse {
+	resps, attempts := rs.multicast(ctx, msgs)
+	for i, msg := range msgs {
+		rs.deadLetter(ctx, msg, resps[i], attempts[i])
+	}
+	return resps
+}
+
+// deadLetter stores msg if it failed. A cancelled request is not
+// dead-lettered, the caller knows it failed.
+func (rs *retryNotificationServer) deadLetter(ctx context.Context, msg *PushNotification, resp PushResponse, attempts int) {
+	if resp[PUSH_STATUS] == PUSH_STATUS_FAIL && rs.deadLetters != nil && ctx.Err() == nil {
+		rs.deadLetters.Add(&DeadLetter{
+			Time:     time.Now(),
+			Type:     rs.pushType,
+			Attempts: attempts,
+			Reason:   resp[PUSH_STATUS_ERROR_MSG],
+			Response: resp,
+			Msg:      msg,
+		})
+	}
+}
+
+func (rs *retryNotificationServer) unwrap() NotificationServer {
+	return rs.NotificationServer
+}
+
+// send delivers msg and returns the last response along with the number of
+// attempts made.
+func (rs *retryNotificationServer) send(ctx context.Context, msg *PushNotification) (PushResponse, int) {
+	for attempt := 1; ; attempt++ {
+		resp := rs.NotificationServer.SendNotification(ctx, msg)
+		if !resp.retryable() || attempt >= rs.policy.maxAttempts || ctx.Err() != nil {
+			return resp, attempt
+		}
+
+		wait, ok := rs.policy.backoff(attempt, resp.retryAfter())
+		if !ok {
+			rs.logger.Errorf("Not retrying push sid=%v did=%v type=%v, provider asked to retry after %v", msg.ServerID, msg.DeviceID, rs.pushType, resp.retryAfter())
+			return resp, attempt
+		}
+
+		rs.logger.Infof("Retrying push sid=%v did=%v type=%v attempt=%v in %v err=%v", msg.ServerID, msg.DeviceID, rs.pushType, attempt+1, wait, resp[PUSH_STATUS_ERROR_MSG])
+		if rs.metrics != nil {
+			rs.metrics.incrementRetry(rs.pushType)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, attempt
+		}
+	}
+}
+
+// multicast delivers msgs and returns the last response of every device
+// along with the number of attempts made for it.
+func (rs *retryNotificationServer) multicast(ctx context.Context, msgs []*PushNotification) ([]PushResponse, []int) {
+	server := rs.NotificationServer.(multicastNotificationServer)
+	resps := make([]PushResponse, len(msgs))
+	attempts := make([]int, len(msgs))
+	pending := make([]int, len(msgs))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for attempt := 1; ; attempt++ {
+		batch := make([]*PushNotification, len(pending))
+		for j, i := range pending {
+			batch[j] = msgs[i]
+			attempts[i]++
+		}
+		var retry []int
+		var retryAfter time.Duration
+		for j, resp := range server.sendMulticast(ctx, batch) {
+			resps[pending[j]] = resp
+			if resp.retryable() {
+				retry = append(retry, pending[j])
+				if resp.retryAfter() > retryAfter {
+					retryAfter = resp.retryAfter()
+				}
+			}
+		}
+		if len(retry) == 0 || attempt >= rs.policy.maxAttempts || ctx.Err() != nil {
+			return resps, attempts
+		}
+
+		wait, ok := rs.policy.backoff(attempt, retryAfter)
+		if !ok {
+			rs.logger.Errorf("Not retrying multicast of %v pushes type=%v, provider asked to retry after %v", len(retry), rs.pushType, retryAfter)
+			return resps, attempts
+		}
+
+		rs.logger.Infof("Retrying multicast of %v pushes type=%v attempt=%v in %v", len(retry), rs.pushType, attempt+1, wait)
+		if rs.metrics != nil {
+			for range retry {
+				rs.metrics.incrementRetry(rs.pushType)
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return resps, attempts
+		}
+		pending = retry
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as
+// an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+type retryAfterKey struct{}
+
+// retryAfterHolder receives the Retry-After, the status code and the
+// transport error of a request sent through a retryAfterTransport, for
+// clients that do not expose them.
+type retryAfterHolder struct {
+	mu         sync.Mutex
+	value      time.Duration
+	statusCode int
+	err        error
+}
+
+func (h *retryAfterHolder) get() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.value
+}
+
+// result returns the status code and the transport error of the request.
+func (h *retryAfterHolder) result() (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.statusCode, h.err
+}
+
+func withRetryAfterHolder(ctx context.Context) (context.Context, *retryAfterHolder) {
+	holder := &retryAfterHolder{}
+	return context.WithValue(ctx, retryAfterKey{}, holder), holder
+}
+
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	holder, ok := req.Context().Value(retryAfterKey{}).(*retryAfterHolder)
+	if !ok {
+		return resp, err
+	}
+
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+	if err != nil {
+		holder.err = err
+		return resp, err
+	}
+	holder.statusCode = resp.StatusCode
+	if retryAfter := parseRetryAfter(resp.Header.Get(HEADER_RETRY_AFTER)); retryAfter > 0 {
+		holder.value = retryAfter
+	}
+	return resp, nil
+}
+
+// isTransientTransportError tells whether a request that failed with err
+// before getting a response may succeed when sent again: timeouts and
+// connections refused, reset or closed early.
+func isTransientTransportError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, target := range []error{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE, io.EOF, io.ErrUnexpectedEOF} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointError is a failure answered by a provider endpoint, such as an
+// access token one, along with whether asking again may succeed.
+type endpointError struct {
+	msg       string
+	transient bool
+}
+
+func (e *endpointError) Error() string {
+	return e.msg
+}
+
+// newStatusEndpointError returns the error of an endpoint that answered
+// statusCode: transient for 5xx and 429 only.
+func newStatusEndpointError(statusCode int, msg string) *endpointError {
+	return &endpointError{msg: msg, transient: statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests}
+}
+
+// isTransientError tells whether a provider call that failed with err may
+// succeed when tried again. Endpoint errors say so themselves; other errors
+// are transient only when they come from the transport.
+func isTransientError(err error) bool {
+	var endpointErr *endpointError
+	if errors.As(err, &endpointErr) {
+		return endpointErr.transient
+	}
+	return isTransientTransportError(err)
+}
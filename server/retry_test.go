@@ -0,0 +1,168 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryNotificationServer(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true}
+	logger := NewLogger(cfg)
+	settings := RetrySettings{MaxAttempts: 3, BaseBackoffMs: 1, MaxBackoffMs: 10}
+	msg := &PushNotification{ServerID: "sid", DeviceID: "did"}
+
+	t.Run("retries transient failures", func(t *testing.T) {
+		target := &fakeNotificationServer{responses: []PushResponse{
+			NewTransientErrorPushResponse("unknown transport error", 0),
+			NewOkPushResponse(),
+		}}
+		resp := newRetryNotificationServer("apple", target, settings, nil, logger, nil).SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_OK, resp[PUSH_STATUS])
+		assert.Equal(t, 2, target.count())
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		target := &fakeNotificationServer{responses: []PushResponse{
+			NewTransientErrorPushResponse("ServiceUnavailable", 0),
+		}}
+		resp := newRetryNotificationServer("apple", target, settings, nil, logger, nil).SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, 3, target.count())
+	})
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		for _, r := range []PushResponse{NewRemovePushResponse(), NewErrorPushResponse("BadDeviceToken")} {
+			target := &fakeNotificationServer{responses: []PushResponse{r}}
+			resp := newRetryNotificationServer("apple", target, settings, nil, logger, nil).SendNotification(context.Background(), msg)
+			assert.Equal(t, r[PUSH_STATUS], resp[PUSH_STATUS])
+			assert.Equal(t, 1, target.count())
+		}
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		target := &fakeNotificationServer{responses: []PushResponse{
+			NewTransientErrorPushResponse("unknown transport error", 0),
+		}}
+		slow := RetrySettings{MaxAttempts: 3, BaseBackoffMs: 60000, MaxBackoffMs: 60000}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		resp := newRetryNotificationServer("apple", target, slow, nil, logger, nil).SendNotification(ctx, msg)
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, 1, target.count())
+	})
+
+	t.Run("does not wait longer than the max backoff", func(t *testing.T) {
+		target := &fakeNotificationServer{responses: []PushResponse{
+			NewTransientErrorPushResponse("TooManyRequests", time.Minute),
+		}}
+		resp := newRetryNotificationServer("apple", target, settings, nil, logger, nil).SendNotification(context.Background(), msg)
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, 1, target.count())
+	})
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := newRetryPolicy(RetrySettings{BaseBackoffMs: 100, MaxBackoffMs: 1000, Jitter: 0.1})
+	assert.Equal(t, defaultRetryMaxAttempts, p.maxAttempts)
+
+	d, ok := p.backoff(1, 0)
+	require.True(t, ok)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(d), float64(10*time.Millisecond))
+
+	d, ok = p.backoff(3, 0)
+	require.True(t, ok)
+	assert.InDelta(t, float64(400*time.Millisecond), float64(d), float64(40*time.Millisecond))
+
+	d, ok = p.backoff(10, 0)
+	require.True(t, ok)
+	assert.InDelta(t, float64(time.Second), float64(d), float64(100*time.Millisecond))
+
+	d, ok = p.backoff(1, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, time.Second, d)
+
+	_, ok = p.backoff(1, 2*time.Second)
+	assert.False(t, ok)
+}
+
+func TestTransientResponseJSON(t *testing.T) {
+	resp := NewTransientErrorPushResponse("ServiceUnavailable", 30*time.Second)
+	require.True(t, resp.retryable())
+	assert.Equal(t, `{"error":"ServiceUnavailable","status":"FAIL"}`, resp.ToJson())
+
+	buf, err := json.Marshal([]PushResponse{resp})
+	require.NoError(t, err)
+	assert.Equal(t, `[{"error":"ServiceUnavailable","status":"FAIL"}]`, string(buf))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30"))
+
+	d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, d > 50*time.Second && d <= time.Minute, d)
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HEADER_RETRY_AFTER, "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &retryAfterTransport{base: http.DefaultTransport}}
+	ctx, holder := withRetryAfterHolder(context.Background())
+	req, err := http.NewRequest("POST", ts.URL, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, 5*time.Second, holder.get())
+}
+
+func TestTransientProviderErrors(t *testing.T) {
+	assert.True(t, isAppleTransientError("ServiceUnavailable"))
+	assert.True(t, isAppleTransientError("TooManyRequests"))
+	assert.False(t, isAppleTransientError("BadDeviceToken"))
+
+	assert.True(t, isFCMv1TransientError(http.StatusServiceUnavailable, ""))
+	assert.True(t, isFCMv1TransientError(http.StatusTooManyRequests, FCMv1ErrorQuotaExceeded))
+	assert.False(t, isFCMv1TransientError(http.StatusBadRequest, FCMv1ErrorInvalidArgument))
+
+	assert.True(t, isTransientTransportError(context.DeadlineExceeded))
+	assert.True(t, isTransientTransportError(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}))
+	assert.True(t, isTransientTransportError(fmt.Errorf("read: %w", io.ErrUnexpectedEOF)))
+	assert.False(t, isTransientTransportError(nil))
+	assert.False(t, isTransientTransportError(context.Canceled))
+	assert.False(t, isTransientTransportError(x509.UnknownAuthorityError{}))
+	assert.False(t, isTransientTransportError(&net.DNSError{Err: "no such host", Name: "fcm.invalid"}))
+
+	assert.True(t, isTransientError(newStatusEndpointError(http.StatusBadGateway, "bad gateway")))
+	assert.False(t, isTransientError(newStatusEndpointError(http.StatusUnauthorized, "invalid_grant")))
+	assert.False(t, isTransientError(fmt.Errorf("token: %w", x509.UnknownAuthorityError{})))
+	assert.True(t, isTransientError(context.DeadlineExceeded))
+
+	resp := NewTransientErrorPushResponse("QUOTA_EXCEEDED", 10*time.Second)
+	assert.True(t, resp.retryable())
+	assert.Equal(t, 10*time.Second, resp.retryAfter())
+	assert.False(t, NewErrorPushResponse("BadDeviceToken").retryable())
+}
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -32,7 +34,7 @@ var (
 )
 
 type NotificationServer interface {
-	SendNotification(msg *PushNotification) PushResponse
+	SendNotification(ctx context.Context, msg *PushNotification) PushResponse
 	Initialize() bool
 }
 
@@ -43,14 +45,48 @@ type Server struct {
 	pushTargets map[string]NotificationServer
 	metrics     *metrics
 	logger      *Logger
+
+	// ctx is the parent of every outbound call, cancelled on shutdown.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	draining int32
+
+	// sends counts the send handlers running, so that Stop waits for them
+	// to set aside what they could not send. sendsClosed refuses new ones.
+	sendsMu     sync.Mutex
+	sends       sync.WaitGroup
+	sendsClosed bool
+
+	wechatDevices map[string]*wechatDeviceStore
+	queues        map[string]*deliveryQueue
+	breakers      map[string]*circuitBreaker
+	wal           *durableQueue
+	deadLetters   *deadLetterStore
+	dedup         *dedupCache
+	auth          *serverAuthenticator
+	registry      *serverRegistry
+	usage         *usageStore
+	proxies       trustedProxies
 }
 
 // New returns a new Server instance.
 func New(cfg *ConfigPushProxy, logger *Logger) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	var dedup *dedupCache
+	if cfg.DedupTTLSeconds > 0 {
+		dedup = newDedupCache(time.Duration(cfg.DedupTTLSeconds)*time.Second, cfg.DedupMaxEntries)
+	}
 	return &Server{
 		cfg:         cfg,
 		pushTargets: make(map[string]NotificationServer),
 		logger:      logger,
+		ctx:         ctx,
+		cancel:      cancel,
+
+		wechatDevices: make(map[string]*wechatDeviceStore),
+		queues:        make(map[string]*deliveryQueue),
+		breakers:      make(map[string]*circuitBreaker),
+		dedup:         dedup,
 	}
 }
 
@@ -63,30 +99,73 @@ func (s *Server) Start() {
 		s.logger.Infof("Proxy server detected. Routing all requests through: %s", proxyServer)
 	}
 
-	var m *metrics
 	if s.cfg.EnableMetrics {
-		m = newMetrics()
-		s.metrics = m
+		s.metrics = newMetrics()
 	}
 
-	for _, settings := range s.cfg.ApplePushSettings {
-		server := NewAppleNotificationServer(settings, s.logger, m)
-		if server.Initialize() {
-			s.pushTargets[settings.Type] = server
+	if s.cfg.EnableAsyncDelivery && s.cfg.QueueDirectory != "" {
+		wal, err := newDurableQueue(s.cfg.QueueDirectory, s.logger)
+		if err != nil {
+			s.logger.Panicf("Failed to open the delivery queue in %v err=%v", s.cfg.QueueDirectory, err)
 		}
+		interval := time.Duration(s.cfg.QueueCompactIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultQueueCompactInterval
+		}
+		wal.startCompaction(interval)
+		s.wal = wal
 	}
 
-	for _, settings := range s.cfg.AndroidPushSettings {
-		server := NewAndroidNotificationServerW(settings, s.logger, m)
-		if server.Initialize() {
-			s.pushTargets[settings.Type] = server
+	auth, err := newServerAuthenticator(s.cfg)
+	if err != nil {
+		s.logger.Panicf("Failed to configure server authentication err=%v", err)
+	}
+	s.auth = auth
+
+	registry, err := newServerRegistry(s.cfg, s.logger)
+	if err != nil {
+		s.logger.Panicf("Failed to load the server registry err=%v", err)
+	}
+	s.registry = registry
+
+	if s.cfg.UsageFile != "" {
+		usage, err := newUsageStore(s.cfg.UsageFile, s.logger)
+		if err != nil {
+			s.logger.Panicf("Failed to load the usage counters from %v err=%v", s.cfg.UsageFile, err)
+		}
+		interval := time.Duration(s.cfg.UsageFlushIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultUsageFlushInterval
+		}
+		usage.startFlushing(interval)
+		s.usage = usage
+		registry.seedUsage(usage.Records(&UsageFilter{From: time.Now().UTC().Format("2006-01") + "-01"}))
+	}
+
+	s.initPushTargets()
+
+	if s.wal != nil {
+		go s.replayPendingNotifications()
+	}
+
+	proxies, err := newTrustedProxies(s.cfg.TrustedProxies)
+	if err != nil {
+		s.logger.Panicf("Failed to parse TrustedProxies err=%v", err)
+	}
+	s.proxies = proxies
+	if s.cfg.ProxyProtocol && s.proxies == nil {
+		s.logger.Panic("ProxyProtocol requires TrustedProxies")
+	}
+	for _, header := range strings.Fields(s.cfg.ThrottleVaryByHeader) {
+		if isForwardedHeader(header) && s.proxies == nil {
+			s.logger.Errorf("ThrottleVaryByHeader %v is ignored without TrustedProxies, the throttle varies by the peer address", header)
 		}
 	}
 
 	router := mux.NewRouter()
 	vary := throttled.VaryBy{}
 	vary.RemoteAddr = false
-	vary.Headers = strings.Fields(s.cfg.ThrottleVaryByHeader)
+	vary.Custom = s.throttleKey
 	th := throttled.RateLimit(throttled.PerSec(s.cfg.ThrottlePerSec), &vary, throttledStore.NewMemStore(s.cfg.ThrottleMemoryStoreSize))
 
 	th.DeniedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -97,27 +176,56 @@ func (s *Server) Start() {
 	handler := th.Throttle(router)
 
 	router.HandleFunc("/", root).Methods("GET")
+	router.HandleFunc("/ready", s.handleReady).Methods("GET")
 
 	metricCompatibleSendNotificationHandler := s.handleSendNotification
 	metricCompatibleAckNotificationHandler := s.handleAckNotification
+	metricCompatibleSendBatchHandler := s.handleSendNotificationBatch
 	if s.cfg.EnableMetrics {
 		metrics := NewPrometheusHandler()
 		router.Handle("/metrics", metrics).Methods("GET")
 		metricCompatibleSendNotificationHandler = s.responseTimeMiddleware(s.handleSendNotification)
 		metricCompatibleAckNotificationHandler = s.responseTimeMiddleware(s.handleAckNotification)
+		metricCompatibleSendBatchHandler = s.responseTimeMiddleware(s.handleSendNotificationBatch)
 	}
 	r := router.PathPrefix("/api/v1").Subrouter()
-	r.HandleFunc("/send_push", metricCompatibleSendNotificationHandler).Methods("POST")
+	r.HandleFunc("/send_push", s.trackSends(s.serverAuthMiddleware(metricCompatibleSendNotificationHandler))).Methods("POST")
+	r.HandleFunc("/send_push_batch", s.trackSends(s.serverAuthMiddleware(metricCompatibleSendBatchHandler))).Methods("POST")
 	r.HandleFunc("/ack", metricCompatibleAckNotificationHandler).Methods("POST")
+	r.HandleFunc("/status", s.handleStatus).Methods("GET")
+	s.initAdminRoutes(r)
+
+	tlsConfig, err := newTLSConfig(s.cfg, s.logger)
+	if err != nil {
+		s.logger.Panicf("Failed to configure TLS err=%v", err)
+	}
 
 	s.httpServer = &http.Server{
 		Addr:         s.cfg.ListenAddress,
 		Handler:      handlers.RecoveryHandler(handlers.PrintRecoveryStack(true))(handler),
 		ReadTimeout:  time.Duration(CONNECTION_TIMEOUT_SECONDS) * time.Second,
 		WriteTimeout: time.Duration(CONNECTION_TIMEOUT_SECONDS) * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return s.ctx },
+		TLSConfig:    tlsConfig,
+	}
+	addr := s.cfg.ListenAddress
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.logger.Panic(err.Error())
+	}
+	if s.cfg.ProxyProtocol {
+		ln = newProxyProtocolListener(ln, s.proxies, s.logger)
 	}
 	go func() {
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if tlsConfig != nil {
+			err = s.httpServer.ServeTLS(ln, "", "")
+		} else {
+			err = s.httpServer.Serve(ln)
+		}
 		if err != http.ErrServerClosed {
 			s.logger.Panic(err.Error())
 		}
@@ -126,19 +234,183 @@ func (s *Server) Start() {
 	s.logger.Info("Server is listening on " + s.cfg.ListenAddress)
 }
 
-// Stop stops the server.
+// initPushTargets creates and initializes the configured push targets,
+// along with their delivery queues when asynchronous delivery is enabled.
+func (s *Server) initPushTargets() {
+	if s.cfg.DeadLetterFile != "" {
+		s.deadLetters = newDeadLetterStore(s.cfg.DeadLetterFile, s.logger)
+	}
+
+	targets, err := s.cfg.pushTargetSettings()
+	if err != nil {
+		s.logger.Panicf("Failed to read push targets err=%v", err)
+	}
+	backends := make(map[string]NotificationServer)
+	delivery := make(map[string]DeliverySettings)
+	for _, settings := range targets {
+		server, err := newProviderServer(&PushTarget{PushTargetSettings: settings, Logger: s.logger, metrics: s.metrics})
+		if err != nil {
+			s.logger.Panicf("Failed to create notification server err=%v", err)
+		}
+		if server.Initialize() {
+			if wechat, ok := server.(*AndroidNotificationServerW); ok {
+				s.wechatDevices[settings.Type] = wechat.devices
+			}
+			if !settings.Delivery.CircuitBreaker.Disabled {
+				breaker := newCircuitBreaker(settings.Type, server, settings.Delivery.CircuitBreaker, s.logger, s.metrics)
+				s.breakers[settings.Type] = breaker
+				server = breaker
+			}
+			backends[settings.Type] = server
+			delivery[settings.Type] = settings.Delivery
+			s.addPushTarget(settings.Type, newRetryNotificationServer(settings.Type, server, settings.Delivery.Retry, s.deadLetters, s.logger, s.metrics), settings.Delivery)
+		}
+	}
+
+	for _, chain := range s.cfg.FailoverChains {
+		if _, ok := s.pushTargets[chain.Type]; ok || chain.Type == "" {
+			s.logger.Panicf("Failover chain type=%v is empty or already used by a push target", chain.Type)
+		}
+		failover := &failoverNotificationServer{pushType: chain.Type, logger: s.logger}
+		for _, pushType := range chain.Targets {
+			backend, ok := backends[pushType]
+			if !ok {
+				s.logger.Panicf("Failover chain type=%v uses unknown push target type=%v", chain.Type, pushType)
+			}
+			// Failures of a backend are dead-lettered by the chain only,
+			// once every backend failed.
+			server := newRetryNotificationServer(pushType, backend, delivery[pushType].Retry, nil, s.logger, s.metrics)
+			failover.backends = append(failover.backends, failoverBackend{pushType: pushType, server: server})
+		}
+		if len(failover.backends) == 0 {
+			s.logger.Panicf("Failover chain type=%v has no targets", chain.Type)
+		}
+		settings := DeliverySettings{Retry: RetrySettings{MaxAttempts: 1}}
+		s.addPushTarget(chain.Type, newRetryNotificationServer(chain.Type, failover, settings.Retry, s.deadLetters, s.logger, s.metrics), settings)
+	}
+}
+
+func (s *Server) addPushTarget(pushType string, server NotificationServer, settings DeliverySettings) {
+	if s.usage != nil || s.registry != nil {
+		server = &usageNotificationServer{NotificationServer: server, pushType: pushType, usage: s.usage, registry: s.registry}
+	}
+	s.pushTargets[pushType] = server
+	if s.cfg.EnableAsyncDelivery {
+		queue := newDeliveryQueue(pushType, server, settings, s.wal, s.deadLetters, s.logger, s.metrics)
+		queue.start(s.ctx)
+		s.queues[pushType] = queue
+	}
+}
+
+// Stop drains and stops the server. It first reports not-ready so that load
+// balancers stop sending traffic, then stops accepting requests and waits,
+// up to the drain timeout, for in-flight and queued notifications. Whatever
+// is left is aborted and kept in the durable queue or the dead-letter file.
 func (s *Server) Stop() {
 	s.logger.Info("Stopping Server...")
-	ctx, cancel := context.WithTimeout(context.Background(), WAIT_FOR_SERVER_SHUTDOWN)
-	defer cancel()
-	if s.metrics != nil {
-		s.metrics.shutdown()
+	atomic.StoreInt32(&s.draining, 1)
+	if delay := time.Duration(s.cfg.DrainDelaySeconds) * time.Second; delay > 0 {
+		s.logger.Infof("Reporting not ready for %v before draining", delay)
+		time.Sleep(delay)
 	}
+
+	timeout := time.Duration(s.cfg.DrainTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = WAIT_FOR_SERVER_SHUTDOWN
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
 	// Close shop
+	drained := true
 	err := s.httpServer.Shutdown(ctx)
 	if err != nil {
-		s.logger.Error(err.Error())
+		s.logger.Errorf("Failed to finish in-flight requests within %v err=%v", timeout, err)
+		drained = false
 	}
+	for _, queue := range s.queues {
+		if !queue.stop(ctx) {
+			drained = false
+		}
+	}
+	if !drained {
+		// Abort the provider calls still running and wait for the workers to
+		// set aside what they could not send.
+		s.cancel()
+		for _, queue := range s.queues {
+			queue.wait()
+		}
+	}
+	// The aborted synchronous sends may still be writing their dead letters
+	// and usage counts.
+	s.sendsMu.Lock()
+	s.sendsClosed = true
+	s.sendsMu.Unlock()
+	s.sends.Wait()
+
+	if s.usage != nil {
+		if err := s.usage.close(); err != nil {
+			s.logger.Errorf("Failed to write usage counters to %v err=%v", s.cfg.UsageFile, err)
+		}
+	}
+	if s.wal != nil {
+		if err := s.wal.close(); err != nil {
+			s.logger.Errorf("Failed to close the delivery queue err=%v", err)
+		}
+	}
+	s.cancel()
+	if s.metrics != nil {
+		s.metrics.shutdown()
+	}
+	s.logger.Info("Server stopped")
+}
+
+// trackSends counts the requests of next in s.sends, refusing them once
+// Stop is waiting for the last ones.
+func (s *Server) trackSends(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.sendsMu.Lock()
+		if s.sendsClosed {
+			s.sendsMu.Unlock()
+			writeJSONError(w, http.StatusServiceUnavailable, "server stopping")
+			return
+		}
+		s.sends.Add(1)
+		s.sendsMu.Unlock()
+		defer s.sends.Done()
+
+		next(w, r)
+	}
+}
+
+// replayPendingNotifications queues again the notifications accepted before
+// a restart that no provider answered for.
+func (s *Server) replayPendingNotifications() {
+	pending := s.wal.Pending()
+	if len(pending) == 0 {
+		return
+	}
+
+	s.logger.Infof("Replaying %v pending notifications", len(pending))
+	for _, record := range pending {
+		queue, ok := s.queues[record.Type]
+		if !ok {
+			s.logger.Errorf("Cannot replay pending notification seq=%v, no push target for type=%v", record.Seq, record.Type)
+			continue
+		}
+		if !queue.replay(record) {
+			return
+		}
+	}
+}
+
+// handleReady is the readiness probe. It fails once the server is draining.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.draining) == 1 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{PUSH_STATUS: "DRAINING"})
+		return
+	}
+	writeJSON(w, http.StatusOK, NewOkPushResponse())
 }
 
 func root(w http.ResponseWriter, r *http.Request) {
@@ -169,45 +441,135 @@ func (s *Server) handleSendNotification(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	resp, status := s.sendPushNotification(r.Context(), msg)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	_, _ = w.Write([]byte(resp.ToJson()))
+}
+
+// sendPushNotification validates msg and hands it to its push target, or to
+// the target's delivery queue. It returns the response along with the HTTP
+// status to answer with.
+func (s *Server) sendPushNotification(ctx context.Context, msg *PushNotification) (PushResponse, int) {
+	if resp, status := s.checkPushNotification(ctx, msg); resp != nil {
+		return resp, status
+	}
+
+	if s.dedup == nil || msg.ID == "" {
+		return s.deliverPushNotification(ctx, msg)
+	}
+
+	entry, first := s.dedup.begin(dedupKey{serverID: msg.ServerID, deviceID: msg.DeviceID, id: msg.ID})
+	if !first {
+		resp, status, ok := entry.wait(ctx)
+		if !ok {
+			return NewErrorPushResponse(ctx.Err().Error()), http.StatusOK
+		}
+		s.logger.Infof("Duplicate notification answered from cache type=%v serverId=%v id=%v", msg.Platform, msg.ServerID, msg.ID)
+		if s.metrics != nil {
+			s.metrics.incrementDedupHit(msg.Platform)
+		}
+		return resp, status
+	}
+
+	resp, status := s.deliverPushNotification(ctx, msg)
+	s.dedup.finish(entry, resp, status)
+	return resp, status
+}
+
+// checkPushNotification validates msg and checks that the request of ctx
+// may send it. It returns the response of a rejected notification, or nil.
+func (s *Server) checkPushNotification(ctx context.Context, msg *PushNotification) (PushResponse, int) {
 	if msg.ServerID == "" {
 		rMsg := "Failed because of missing server Id"
 		s.logger.Error(rMsg)
-		resp := NewErrorPushResponse(rMsg)
-		_, _ = w.Write([]byte(resp.ToJson()))
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
-		return
+		return NewErrorPushResponse(rMsg), http.StatusOK
 	}
 
 	if msg.DeviceID == "" {
 		rMsg := fmt.Sprintf("Failed because of missing device Id serverId=%v", msg.ServerID)
 		s.logger.Error(rMsg)
-		resp := NewErrorPushResponse(rMsg)
-		_, _ = w.Write([]byte(resp.ToJson()))
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
-		return
+		return NewErrorPushResponse(rMsg), http.StatusOK
+	}
+
+	if s.auth != nil {
+		if status, reason := s.auth.authorize(ctx, msg.ServerID); status != 0 {
+			rMsg := fmt.Sprintf("Not allowed to send for serverId=%v reason=%v", msg.ServerID, reason)
+			s.logger.Error(rMsg)
+			if s.metrics != nil {
+				s.metrics.incrementAuthFailure(reason)
+			}
+			return NewErrorPushResponse(rMsg), status
+		}
 	}
 
 	if len(msg.Message) > 2047 {
 		msg.Message = msg.Message[0:2046]
 	}
+	return nil, 0
+}
 
-	if server, ok := s.pushTargets[msg.Platform]; ok {
-		rMsg := server.SendNotification(msg)
-		_, _ = w.Write([]byte(rMsg.ToJson()))
-		return
-	} else {
+// admitPushNotification checks the notification against the server
+// registry. It returns the response of a rejected notification, or nil.
+func (s *Server) admitPushNotification(msg *PushNotification) (PushResponse, int) {
+	if s.registry != nil {
+		if status, reason := s.registry.check(msg.ServerID, msg.Platform); status != 0 {
+			rMsg := fmt.Sprintf("Rejected notification of serverId=%v type=%v: %v", msg.ServerID, msg.Platform, reason)
+			s.logger.Error(rMsg)
+			return NewErrorPushResponse(rMsg), status
+		}
+	}
+	return nil, 0
+}
+
+// deliverPushNotification admits the notification, then queues or sends it.
+func (s *Server) deliverPushNotification(ctx context.Context, msg *PushNotification) (PushResponse, int) {
+	if resp, status := s.admitPushNotification(msg); resp != nil {
+		return resp, status
+	}
+
+	if queue, ok := s.queues[msg.Platform]; ok {
+		if !queue.enqueue(msg) {
+			rMsg := fmt.Sprintf("Delivery queue is full type=%v serverId=%v", msg.Platform, msg.ServerID)
+			s.logger.Error(rMsg)
+			return NewErrorPushResponse(rMsg), http.StatusServiceUnavailable
+		}
+		return NewAcceptedPushResponse(), http.StatusAccepted
+	}
+
+	server, ok := s.pushTargets[msg.Platform]
+	if !ok {
 		rMsg := fmt.Sprintf("Did not send message because of missing platform property type=%v serverId=%v", msg.Platform, msg.ServerID)
 		s.logger.Error(rMsg)
-		resp := NewErrorPushResponse(rMsg)
-		_, _ = w.Write([]byte(resp.ToJson()))
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
-		return
+		return NewErrorPushResponse(rMsg), http.StatusOK
+	}
+	resp := server.SendNotification(ctx, msg)
+	s.deadLetterAborted(ctx, msg, resp)
+	return resp, http.StatusOK
+}
+
+// deadLetterAborted keeps a synchronous send aborted by Stop, rather than by
+// the client going away, like the queued ones. The retry wrapper does not
+// dead-letter cancelled sends.
+func (s *Server) deadLetterAborted(ctx context.Context, msg *PushNotification, resp PushResponse) {
+	if resp[PUSH_STATUS] == PUSH_STATUS_FAIL && s.deadLetters != nil && ctx.Err() != nil && s.ctx.Err() != nil {
+		s.deadLetters.Add(&DeadLetter{
+			Time:     time.Now(),
+			Type:     msg.Platform,
+			Reason:   "shutdown",
+			Response: NewErrorPushResponse("shutdown"),
+			Msg:      msg,
+		})
 	}
 }
 
@@ -268,22 +630,36 @@ func (s *Server) handleAckNotification(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(rMsg.ToJson()))
 }
 
+// getIpAddress returns the client address of the request. The forwarded
+// headers are only believed from TrustedProxies.
 func (s *Server) getIpAddress(r *http.Request) string {
-	address := r.Header.Get(HEADER_FORWARDED)
-	var err error
+	if s.proxies != nil {
+		return s.proxies.clientIP(r)
+	}
 
-	if address == "" {
-		address = r.Header.Get(HEADER_REAL_IP)
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		s.logger.Errorf("error in getting IP address: %v", err)
+		return r.RemoteAddr
 	}
+	return address
+}
 
-	if address == "" {
-		address, _, err = net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			s.logger.Errorf("error in getting IP address: %v", err)
+// throttleKey varies the throttle by client IP and by the other
+// ThrottleVaryByHeader headers. The forwarded headers are never used as is.
+func (s *Server) throttleKey(r *http.Request) string {
+	key := s.getIpAddress(r)
+	for _, header := range strings.Fields(s.cfg.ThrottleVaryByHeader) {
+		if !isForwardedHeader(header) {
+			key += "\n" + r.Header.Get(header)
 		}
 	}
+	return key
+}
 
-	return address
+func isForwardedHeader(header string) bool {
+	header = http.CanonicalHeaderKey(header)
+	return header == HEADER_FORWARDED || header == http.CanonicalHeaderKey(HEADER_REAL_IP)
 }
 
 func getProxyServer() string {
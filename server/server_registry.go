@@ -0,0 +1,337 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ServerStatusAllowed = "allowed"
+	ServerStatusBlocked = "blocked"
+)
+
+// RegisteredServer is a Mattermost server known to the proxy. Quotas of 0
+// are unlimited and an empty Platforms allows every push target type.
+type RegisteredServer struct {
+	ServerID     string   `json:"server_id"`
+	Name         string   `json:"name,omitempty"`
+	Status       string   `json:"status"`
+	DailyQuota   int      `json:"daily_quota,omitempty"`
+	MonthlyQuota int      `json:"monthly_quota,omitempty"`
+	Platforms    []string `json:"platforms,omitempty"`
+
+	// DailyUsage and MonthlyUsage are reported by the admin API only.
+	DailyUsage   int `json:"daily_usage,omitempty"`
+	MonthlyUsage int `json:"monthly_usage,omitempty"`
+}
+
+func (me *RegisteredServer) isValid() error {
+	if me.ServerID == "" {
+		return fmt.Errorf("server_id is required")
+	}
+	if me.Status != ServerStatusAllowed && me.Status != ServerStatusBlocked {
+		return fmt.Errorf("status must be %v or %v", ServerStatusAllowed, ServerStatusBlocked)
+	}
+	if me.DailyQuota < 0 || me.MonthlyQuota < 0 {
+		return fmt.Errorf("quotas cannot be negative")
+	}
+	return nil
+}
+
+func (me *RegisteredServer) allowsPlatform(platform string) bool {
+	if len(me.Platforms) == 0 {
+		return true
+	}
+	for _, p := range me.Platforms {
+		if p == platform {
+			return true
+		}
+	}
+	return false
+}
+
+type serverUsage struct {
+	day        string
+	dayCount   int
+	month      string
+	monthCount int
+}
+
+// roll resets the counters when the UTC day or month changed.
+func (u *serverUsage) roll(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+	if u.day != day {
+		u.day = day
+		u.dayCount = 0
+	}
+	month := now.UTC().Format("2006-01")
+	if u.month != month {
+		u.month = month
+		u.monthCount = 0
+	}
+}
+
+// serverRegistry holds the known Mattermost servers and enforces their
+// status, platforms and quotas. It is seeded from the config and, when a file
+// is set, persisted there on every change; an existing file replaces the
+// servers of the config. The quota counters live in memory and count the
+// notifications sent, like the usage counters seedUsage restores them from
+// on start; without UsageFile they start over on every restart.
+type serverRegistry struct {
+	path          string
+	rejectUnknown bool
+
+	mu      sync.Mutex
+	servers map[string]*RegisteredServer
+	usage   map[string]*serverUsage
+	now     func() time.Time
+}
+
+func newServerRegistry(cfg *ConfigPushProxy, logger *Logger) (*serverRegistry, error) {
+	reg := &serverRegistry{
+		path:          cfg.ServerRegistryFile,
+		rejectUnknown: cfg.RejectUnknownServers,
+		servers:       make(map[string]*RegisteredServer),
+		usage:         make(map[string]*serverUsage),
+		now:           time.Now,
+	}
+
+	servers := make([]*RegisteredServer, 0, len(cfg.Servers))
+	for _, settings := range cfg.Servers {
+		servers = append(servers, settings.toRegisteredServer())
+	}
+
+	if reg.path != "" {
+		buf, err := ioutil.ReadFile(reg.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil && len(buf) > 0 {
+			if len(servers) > 0 {
+				logger.Infof("Ignoring the Servers of the config, the server registry is loaded from %v", reg.path)
+			}
+			servers = nil
+			if err := json.Unmarshal(buf, &servers); err != nil {
+				return nil, fmt.Errorf("failed to parse %v: %v", reg.path, err)
+			}
+		}
+	}
+
+	for _, server := range servers {
+		if server.Status == "" {
+			server.Status = ServerStatusAllowed
+		}
+		if err := server.isValid(); err != nil {
+			return nil, fmt.Errorf("invalid server %q: %v", server.ServerID, err)
+		}
+		if _, ok := reg.servers[server.ServerID]; ok {
+			return nil, fmt.Errorf("server %q is registered twice", server.ServerID)
+		}
+		reg.servers[server.ServerID] = server
+	}
+	return reg, nil
+}
+
+// check tells whether serverID may send a notification to platform. It
+// returns the HTTP status and reason of a rejection. The notification is
+// counted against the quotas by add once sent, so those in flight may go
+// over them.
+func (reg *serverRegistry) check(serverID, platform string) (int, string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	server, ok := reg.servers[serverID]
+	if !ok {
+		if reg.rejectUnknown {
+			return http.StatusForbidden, "unknown server"
+		}
+		return 0, ""
+	}
+	if server.Status == ServerStatusBlocked {
+		return http.StatusForbidden, "server blocked"
+	}
+	if !server.allowsPlatform(platform) {
+		return http.StatusForbidden, fmt.Sprintf("platform %v not allowed", platform)
+	}
+
+	usage := reg.usageOf(serverID)
+	if server.DailyQuota > 0 && usage.dayCount >= server.DailyQuota {
+		return http.StatusTooManyRequests, "daily quota exceeded"
+	}
+	if server.MonthlyQuota > 0 && usage.monthCount >= server.MonthlyQuota {
+		return http.StatusTooManyRequests, "monthly quota exceeded"
+	}
+	return 0, ""
+}
+
+// add counts a notification sent by serverID against its quotas.
+func (reg *serverRegistry) add(serverID string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	usage := reg.usageOf(serverID)
+	usage.dayCount++
+	usage.monthCount++
+}
+
+// usageOf returns the current counters of serverID. It must be called with
+// the lock held.
+func (reg *serverRegistry) usageOf(serverID string) *serverUsage {
+	usage, ok := reg.usage[serverID]
+	if !ok {
+		usage = &serverUsage{}
+		reg.usage[serverID] = usage
+	}
+	usage.roll(reg.now())
+	return usage
+}
+
+// seedUsage sets the quota counters from the usage records, summing the
+// outcomes of every server for the current UTC day and month. The records
+// only count the notifications sent, not those still queued or aborted.
+func (reg *serverRegistry) seedUsage(records []*UsageRecord) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	now := reg.now().UTC()
+	day, month := now.Format(usageDateFormat), now.Format("2006-01")
+	for _, record := range records {
+		if !strings.HasPrefix(record.Date, month) {
+			continue
+		}
+		usage := reg.usageOf(record.ServerID)
+		usage.monthCount += int(record.Count)
+		if record.Date == day {
+			usage.dayCount += int(record.Count)
+		}
+	}
+}
+
+// Get returns a copy of the server with its current usage.
+func (reg *serverRegistry) Get(serverID string) (*RegisteredServer, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	server, ok := reg.servers[serverID]
+	if !ok {
+		return nil, false
+	}
+	return reg.snapshot(server), true
+}
+
+// List returns a copy of every server, sorted by ServerID.
+func (reg *serverRegistry) List() []*RegisteredServer {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	servers := make([]*RegisteredServer, 0, len(reg.servers))
+	for _, server := range reg.servers {
+		servers = append(servers, reg.snapshot(server))
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ServerID < servers[j].ServerID })
+	return servers
+}
+
+func (reg *serverRegistry) snapshot(server *RegisteredServer) *RegisteredServer {
+	copied := *server
+	copied.Platforms = append([]string(nil), server.Platforms...)
+	usage := reg.usageOf(server.ServerID)
+	copied.DailyUsage = usage.dayCount
+	copied.MonthlyUsage = usage.monthCount
+	return &copied
+}
+
+// Set adds or replaces a server and persists the registry.
+func (reg *serverRegistry) Set(server *RegisteredServer) error {
+	if server.Status == "" {
+		server.Status = ServerStatusAllowed
+	}
+	if err := server.isValid(); err != nil {
+		return err
+	}
+	server.DailyUsage = 0
+	server.MonthlyUsage = 0
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	previous, existed := reg.servers[server.ServerID]
+	reg.servers[server.ServerID] = server
+	if err := reg.save(); err != nil {
+		if existed {
+			reg.servers[server.ServerID] = previous
+		} else {
+			delete(reg.servers, server.ServerID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove drops a server and persists the registry. It reports whether the
+// server was registered.
+func (reg *serverRegistry) Remove(serverID string) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	server, ok := reg.servers[serverID]
+	if !ok {
+		return false, nil
+	}
+	delete(reg.servers, serverID)
+	if err := reg.save(); err != nil {
+		reg.servers[serverID] = server
+		return false, err
+	}
+	return true, nil
+}
+
+// save atomically replaces the file with the registry. It must be called
+// with the lock held and does nothing without a file.
+func (reg *serverRegistry) save() error {
+	if reg.path == "" {
+		return nil
+	}
+
+	servers := make([]*RegisteredServer, 0, len(reg.servers))
+	for _, server := range reg.servers {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ServerID < servers[j].ServerID })
+	buf, err := json.MarshalIndent(servers, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(reg.path), filepath.Base(reg.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), reg.path)
+}
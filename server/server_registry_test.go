@@ -0,0 +1,176 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerRegistry(t *testing.T) {
+	cfg := &ConfigPushProxy{EnableConsoleLog: true, Servers: []ServerRegistrationSettings{
+		{ServerID: "blocked", Status: ServerStatusBlocked},
+		{ServerID: "apple-only", Platforms: []string{"apple"}},
+		{ServerID: "limited", DailyQuota: 2, MonthlyQuota: 3},
+	}}
+	srv := New(cfg, NewLogger(cfg))
+	registry, err := newServerRegistry(cfg, srv.logger)
+	require.NoError(t, err)
+	srv.registry = registry
+	srv.addPushTarget("apple", &fakeNotificationServer{}, DeliverySettings{})
+	srv.addPushTarget("android", &fakeNotificationServer{}, DeliverySettings{})
+
+	send := func(serverID, platform string) (PushResponse, int) {
+		return srv.sendPushNotification(context.Background(), &PushNotification{ServerID: serverID, DeviceID: "did", Platform: platform})
+	}
+
+	resp, status := send("blocked", "apple")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+	assert.Contains(t, resp[PUSH_STATUS_ERROR_MSG], "server blocked")
+
+	_, status = send("apple-only", "apple")
+	assert.Equal(t, http.StatusOK, status)
+	resp, status = send("apple-only", "android")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, resp[PUSH_STATUS_ERROR_MSG], "platform android not allowed")
+
+	_, status = send("unknown", "apple")
+	assert.Equal(t, http.StatusOK, status)
+	registry.rejectUnknown = true
+	_, status = send("unknown", "apple")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	t.Run("quotas", func(t *testing.T) {
+		now := time.Date(2020, 1, 30, 12, 0, 0, 0, time.UTC)
+		registry.now = func() time.Time { return now }
+
+		for i := 0; i < 2; i++ {
+			_, status = send("limited", "apple")
+			require.Equal(t, http.StatusOK, status)
+		}
+		resp, status = send("limited", "apple")
+		assert.Equal(t, http.StatusTooManyRequests, status)
+		assert.Contains(t, resp[PUSH_STATUS_ERROR_MSG], "daily quota exceeded")
+
+		server, ok := registry.Get("limited")
+		require.True(t, ok)
+		assert.Equal(t, 2, server.DailyUsage)
+		assert.Equal(t, 2, server.MonthlyUsage)
+
+		// Like the usage counters, aborted sends are not counted.
+		aborted, cancel := context.WithCancel(context.Background())
+		cancel()
+		srv.pushTargets["apple"].SendNotification(aborted, &PushNotification{ServerID: "limited", DeviceID: "did", Platform: "apple"})
+		server, _ = registry.Get("limited")
+		assert.Equal(t, 2, server.DailyUsage)
+
+		// A new day resets the daily quota but not the monthly one.
+		now = now.AddDate(0, 0, 1)
+		_, status = send("limited", "apple")
+		assert.Equal(t, http.StatusOK, status)
+		resp, status = send("limited", "apple")
+		assert.Equal(t, http.StatusTooManyRequests, status)
+		assert.Contains(t, resp[PUSH_STATUS_ERROR_MSG], "monthly quota exceeded")
+
+		now = time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+		_, status = send("limited", "apple")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("usage seeds the quotas", func(t *testing.T) {
+		seeded, err := newServerRegistry(cfg, srv.logger)
+		require.NoError(t, err)
+		seeded.now = func() time.Time { return time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC) }
+		seeded.seedUsage([]*UsageRecord{
+			{Date: "2020-02-28", ServerID: "limited", Platform: "apple", Outcome: PUSH_STATUS_OK, Count: 5},
+			{Date: "2020-03-09", ServerID: "limited", Platform: "apple", Outcome: PUSH_STATUS_OK, Count: 1},
+			{Date: "2020-03-10", ServerID: "limited", Platform: "apple", Outcome: PUSH_STATUS_OK, Count: 1},
+			{Date: "2020-03-10", ServerID: "limited", Platform: "android", Outcome: PUSH_STATUS_FAIL, Count: 1},
+		})
+
+		server, ok := seeded.Get("limited")
+		require.True(t, ok)
+		assert.Equal(t, 2, server.DailyUsage)
+		assert.Equal(t, 3, server.MonthlyUsage)
+		status, reason := seeded.check("limited", "apple")
+		assert.Equal(t, http.StatusTooManyRequests, status)
+		assert.Equal(t, "daily quota exceeded", reason)
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		_, err := newServerRegistry(&ConfigPushProxy{Servers: []ServerRegistrationSettings{{ServerID: "a", Status: "junk"}}}, srv.logger)
+		assert.Error(t, err)
+		_, err = newServerRegistry(&ConfigPushProxy{Servers: []ServerRegistrationSettings{{ServerID: "a"}, {ServerID: "a"}}}, srv.logger)
+		assert.Error(t, err)
+	})
+}
+
+func TestServerRegistryAdminAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &ConfigPushProxy{
+		EnableConsoleLog:   true,
+		AdminToken:         "secret",
+		ServerRegistryFile: filepath.Join(dir, "servers.json"),
+		Servers:            []ServerRegistrationSettings{{ServerID: "from-config"}},
+	}
+	srv := New(cfg, NewLogger(cfg))
+	srv.registry, err = newServerRegistry(cfg, srv.logger)
+	require.NoError(t, err)
+	router := mux.NewRouter()
+	srv.initAdminRoutes(router.PathPrefix("/api/v1").Subrouter())
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	do := func(method, path, body string) (*http.Response, []byte) {
+		rq, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		rq.Header.Set(HEADER_AUTHORIZATION, AUTH_BEARER_PREFIX+"secret")
+		resp, err := http.DefaultClient.Do(rq)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return resp, buf
+	}
+
+	resp, _ := do("PUT", "/api/v1/admin/servers/acme", `{"status":"junk"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = do("PUT", "/api/v1/admin/servers/acme", `{"name":"Acme","status":"blocked","daily_quota":10,"platforms":["apple"]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := do("GET", "/api/v1/admin/servers", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var servers []*RegisteredServer
+	require.NoError(t, json.Unmarshal(body, &servers))
+	require.Len(t, servers, 2)
+	assert.Equal(t, &RegisteredServer{ServerID: "acme", Name: "Acme", Status: ServerStatusBlocked, DailyQuota: 10, Platforms: []string{"apple"}}, servers[0])
+	assert.Equal(t, "from-config", servers[1].ServerID)
+
+	resp, _ = do("DELETE", "/api/v1/admin/servers/from-config", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = do("GET", "/api/v1/admin/servers/from-config", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// The file replaces the servers of the config once it exists.
+	reloaded, err := newServerRegistry(cfg, srv.logger)
+	require.NoError(t, err)
+	require.Len(t, reloaded.List(), 1)
+	server, ok := reloaded.Get("acme")
+	require.True(t, ok)
+	assert.Equal(t, ServerStatusBlocked, server.Status)
+}
@@ -103,3 +103,56 @@ func TestAndroidSend(t *testing.T) {
 	srv.Stop()
 	time.Sleep(time.Second * 2)
 }
+
+func TestProviderRegistry(t *testing.T) {
+	logger := NewLogger(&ConfigPushProxy{EnableConsoleLog: true})
+
+	for provider, expected := range map[string]interface{}{
+		ProviderAPNS:          &AppleNotificationServer{},
+		AndroidProviderWechat: &AndroidNotificationServerW{},
+		AndroidProviderFCM:    &AndroidNotificationServer{},
+		AndroidProviderJPush:  &AndroidNotificationServerJ{},
+	} {
+		srv, err := newProviderServer(&PushTarget{PushTargetSettings: PushTargetSettings{Type: "test", Provider: provider}, Logger: logger})
+		require.NoError(t, err)
+		require.IsType(t, expected, srv)
+	}
+
+	_, err := newProviderServer(&PushTarget{PushTargetSettings: PushTargetSettings{Type: "test", Provider: "junk"}, Logger: logger})
+	require.Error(t, err)
+
+	RegisterProvider("custom", func(target *PushTarget) (NotificationServer, error) {
+		var settings AndroidPushSettings
+		require.NoError(t, target.decodeSettings(&settings))
+		require.Equal(t, "key", settings.AndroidAPIKey)
+		return NewAndroidNotificationServer(settings, target.Logger, nil), nil
+	})
+	defer unregisterProvider("custom")
+	require.Contains(t, Providers(), "custom")
+	require.Panics(t, func() {
+		RegisterProvider("custom", func(*PushTarget) (NotificationServer, error) { return nil, nil })
+	})
+
+	srv, err := newProviderServer(&PushTarget{
+		PushTargetSettings: PushTargetSettings{Type: "test", Provider: "custom", Settings: []byte(`{"AndroidApiKey":"key"}`)},
+		Logger:             logger,
+	})
+	require.NoError(t, err)
+	require.IsType(t, &AndroidNotificationServer{}, srv)
+}
+
+func TestLegacyPushTargetSettings(t *testing.T) {
+	cfg := &ConfigPushProxy{
+		ApplePushSettings:   []ApplePushSettings{{Type: "apple"}},
+		AndroidPushSettings: []AndroidPushSettings{{Type: "android"}, {Type: "android_cn", Provider: AndroidProviderJPush}},
+		PushTargets:         []PushTargetSettings{{Type: "custom", Provider: "custom"}},
+	}
+
+	targets, err := cfg.pushTargetSettings()
+	require.NoError(t, err)
+	require.Len(t, targets, 4)
+	require.Equal(t, ProviderAPNS, targets[0].Provider)
+	require.Equal(t, AndroidProviderWechat, targets[1].Provider)
+	require.Equal(t, AndroidProviderJPush, targets[2].Provider)
+	require.Equal(t, "custom", targets[3].Provider)
+}
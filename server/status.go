@@ -0,0 +1,38 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"net/http"
+	"sort"
+)
+
+type PushTargetStatus struct {
+	Type           string `json:"type"`
+	CircuitBreaker string `json:"circuit_breaker,omitempty"`
+	QueueDepth     *int   `json:"queue_depth,omitempty"`
+}
+
+type ServerStatus struct {
+	PushTargets []PushTargetStatus `json:"push_targets"`
+}
+
+// handleStatus reports the health of every push target.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := ServerStatus{PushTargets: []PushTargetStatus{}}
+	for pushType := range s.pushTargets {
+		target := PushTargetStatus{Type: pushType}
+		if breaker, ok := s.breakers[pushType]; ok {
+			target.CircuitBreaker = breaker.State()
+		}
+		if queue, ok := s.queues[pushType]; ok {
+			depth := len(queue.items)
+			target.QueueDepth = &depth
+		}
+		status.PushTargets = append(status.PushTargets, target)
+	}
+	sort.Slice(status.PushTargets, func(i, j int) bool { return status.PushTargets[i].Type < status.PushTargets[j].Type })
+
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// fileStamp identifies the version of a file on disk.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// tlsReloader serves the listener certificate and the client CA bundle,
+// loading them again when their files change on disk. A file that fails to
+// load keeps the previous version in use.
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	base         *tls.Config
+	logger       *Logger
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	stamps   [3]fileStamp
+}
+
+// newTLSConfig returns the TLS config of the listener, or nil when no
+// certificate is configured.
+func newTLSConfig(cfg *ConfigPushProxy, logger *Logger) (*tls.Config, error) {
+	// Without verified client certificates the mapping would silently never
+	// match.
+	if len(cfg.TLSClientServerIDs) > 0 && cfg.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("TLSClientServerIDs requires TLSClientCAFile")
+	}
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		if cfg.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+		}
+		return nil, nil
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, fmt.Errorf("TLSCertFile and TLSKeyFile must both be set")
+	}
+
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if cfg.TLSMinVersion != "" {
+		version, ok := tlsVersions[cfg.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLSMinVersion %q", cfg.TLSMinVersion)
+		}
+		base.MinVersion = version
+	}
+	if len(cfg.TLSCipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range cfg.TLSCipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+			}
+			base.CipherSuites = append(base.CipherSuites, id)
+		}
+	}
+	if cfg.TLSClientCAFile != "" {
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+		if cfg.TLSClientCertOptional {
+			base.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	reloader := &tlsReloader{
+		certFile:     cfg.TLSCertFile,
+		keyFile:      cfg.TLSKeyFile,
+		clientCAFile: cfg.TLSClientCAFile,
+		base:         base,
+		logger:       logger,
+	}
+	if err := reloader.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	config := base.Clone()
+	config.GetConfigForClient = reloader.getConfigForClient
+	// ServeTLS of Go 1.14 loads the certificate files itself unless the
+	// config has Certificates or GetCertificate.
+	config.GetCertificate = reloader.getCertificate
+	return config, nil
+}
+
+// reloadIfChanged loads the files whose size or modification time differ
+// from the last load.
+func (tr *tlsReloader) reloadIfChanged() error {
+	var stamps [3]fileStamp
+	var err error
+	if stamps[0], err = statFile(tr.certFile); err != nil {
+		return err
+	}
+	if stamps[1], err = statFile(tr.keyFile); err != nil {
+		return err
+	}
+	if tr.clientCAFile != "" {
+		if stamps[2], err = statFile(tr.clientCAFile); err != nil {
+			return err
+		}
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if stamps == tr.stamps {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(tr.certFile, tr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the TLS certificate: %v", err)
+	}
+	var clientCA *x509.CertPool
+	if tr.clientCAFile != "" {
+		buf, err := ioutil.ReadFile(tr.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("no certificate found in %v", tr.clientCAFile)
+		}
+	}
+
+	if tr.cert != nil {
+		tr.logger.Infof("Reloaded the TLS certificate from %v", tr.certFile)
+	}
+	tr.cert = &cert
+	tr.clientCA = clientCA
+	tr.stamps = stamps
+	return nil
+}
+
+func (tr *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if err := tr.reloadIfChanged(); err != nil {
+		tr.logger.Errorf("Failed to reload the TLS certificates, keeping the previous ones err=%v", err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	config := tr.base.Clone()
+	config.Certificates = []tls.Certificate{*tr.cert}
+	config.ClientCAs = tr.clientCA
+	return config, nil
+}
+
+func (tr *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.cert, nil
+}
+
+// clientCertServerID returns the ServerID mapped to the subject of the
+// verified client certificate of the request, matching the full subject
+// first and then the common name.
+func clientCertServerID(r *http.Request, serverIDs map[string]string) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(serverIDs) == 0 {
+		return ""
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if serverID, ok := serverIDs[subject.String()]; ok {
+		return serverID
+	}
+	return serverIDs[subject.CommonName]
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, serial int64, commonName string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, 1, "Push Proxy CA", nil)
+	serverCert := newTestCert(t, 2, "proxy", ca)
+	clientCert := newTestCert(t, 3, "acme", ca)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeCert := func(c *testCert, modTime time.Time) {
+		require.NoError(t, ioutil.WriteFile(certFile, c.certPEM, 0600))
+		require.NoError(t, ioutil.WriteFile(keyFile, c.keyPEM, 0600))
+		require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	writeCert(serverCert, time.Now().Add(-time.Minute))
+	require.NoError(t, ioutil.WriteFile(caFile, ca.certPEM, 0600))
+
+	cfg := &ConfigPushProxy{
+		EnableConsoleLog:   true,
+		TLSCertFile:        certFile,
+		TLSKeyFile:         keyFile,
+		TLSMinVersion:      "1.2",
+		TLSCipherSuites:    []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		TLSClientCAFile:    caFile,
+		TLSClientServerIDs: map[string]string{"acme": "sid-acme"},
+	}
+	srv := New(cfg, NewLogger(cfg))
+	srv.auth, err = newServerAuthenticator(cfg)
+	require.NoError(t, err)
+	srv.pushTargets["apple"] = &fakeNotificationServer{}
+
+	tlsConfig, err := newTLSConfig(cfg, srv.logger)
+	require.NoError(t, err)
+	// What ServeTLS of Go 1.14 requires to not load the empty file names.
+	require.NotNil(t, tlsConfig.GetCertificate)
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.NotNil(t, cert)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpServer := &http.Server{Handler: srv.serverAuthMiddleware(srv.handleSendNotification), TLSConfig: tlsConfig}
+	go func() { _ = httpServer.ServeTLS(ln, "", "") }()
+	defer httpServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(cert *testCert) *http.Client {
+		config := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+	}
+	send := func(c *http.Client, serverID string) (*http.Response, error) {
+		body := `{"platform":"apple","server_id":"` + serverID + `","device_id":"did"}`
+		resp, err := c.Post("https://"+ln.Addr().String()+"/api/v1/send_push", "application/json", strings.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	_, err = send(client(nil), "sid-acme")
+	assert.Error(t, err, "a client certificate is required")
+
+	resp, err := send(client(clientCert), "sid-acme")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, big.NewInt(2), resp.TLS.PeerCertificates[0].SerialNumber)
+
+	resp, err = send(client(clientCert), "sid-other")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// A new certificate on disk is served without a restart.
+	writeCert(newTestCert(t, 4, "proxy", ca), time.Now())
+	resp, err = send(client(clientCert), "sid-acme")
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(4), resp.TLS.PeerCertificates[0].SerialNumber)
+
+	// A broken certificate keeps the previous one in use.
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("junk"), 0600))
+	resp, err = send(client(clientCert), "sid-acme")
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(4), resp.TLS.PeerCertificates[0].SerialNumber)
+}
+
+func TestTLSConfig(t *testing.T) {
+	logger := NewLogger(&ConfigPushProxy{EnableConsoleLog: true})
+
+	config, err := newTLSConfig(&ConfigPushProxy{}, logger)
+	require.NoError(t, err)
+	assert.Nil(t, config)
+
+	for _, cfg := range []*ConfigPushProxy{
+		{TLSCertFile: "cert.pem"},
+		{TLSClientCAFile: "ca.pem"},
+		{TLSClientServerIDs: map[string]string{"acme": "sid"}},
+		{TLSClientServerIDs: map[string]string{"acme": "sid"}, TLSClientCAFile: "ca.pem"},
+		{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSClientServerIDs: map[string]string{"acme": "sid"}},
+		{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSMinVersion: "2.0"},
+		{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{TLSCertFile: "missing.pem", TLSKeyFile: "missing.pem"},
+	} {
+		_, err := newTLSConfig(cfg, logger)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	usageDateFormat           = "2006-01-02"
+	defaultUsageFlushInterval = time.Minute
+)
+
+// UsageRecord counts the notifications of one server, UTC day, push target
+// type and outcome.
+type UsageRecord struct {
+	Date     string `json:"date"`
+	ServerID string `json:"server_id"`
+	Platform string `json:"platform"`
+	Outcome  string `json:"outcome"`
+	Count    int64  `json:"count"`
+}
+
+type usageKey struct {
+	date     string
+	serverID string
+	platform string
+	outcome  string
+}
+
+// UsageFilter selects usage records. From and To are inclusive dates in
+// YYYY-MM-DD format; empty fields match everything.
+type UsageFilter struct {
+	ServerID string
+	From     string
+	To       string
+}
+
+func (f *UsageFilter) IsValid() error {
+	for _, date := range []string{f.From, f.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(usageDateFormat, date); err != nil {
+			return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the record passes the filter.
+func (f *UsageFilter) Match(record *UsageRecord) bool {
+	if f.ServerID != "" && f.ServerID != record.ServerID {
+		return false
+	}
+	if f.From != "" && record.Date < f.From {
+		return false
+	}
+	if f.To != "" && record.Date > f.To {
+		return false
+	}
+	return true
+}
+
+// usageStore counts the outcome of the notifications sent for every server.
+// The counters live in memory and are written to a JSON file periodically
+// and on shutdown.
+type usageStore struct {
+	path   string
+	logger *Logger
+	now    func() time.Time
+
+	mu     sync.Mutex
+	counts map[usageKey]int64
+	dirty  bool
+
+	stopChan chan struct{}
+	stopped  chan struct{}
+}
+
+func newUsageStore(path string, logger *Logger) (*usageStore, error) {
+	us := &usageStore{
+		path:   path,
+		logger: logger,
+		now:    time.Now,
+		counts: make(map[usageKey]int64),
+	}
+
+	records, err := ReadUsage(path, &UsageFilter{})
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		us.counts[usageKey{date: record.Date, serverID: record.ServerID, platform: record.Platform, outcome: record.Outcome}] += record.Count
+	}
+	return us, nil
+}
+
+func (us *usageStore) add(serverID, platform, outcome string) {
+	key := usageKey{
+		date:     us.now().UTC().Format(usageDateFormat),
+		serverID: serverID,
+		platform: platform,
+		outcome:  outcome,
+	}
+
+	us.mu.Lock()
+	us.counts[key]++
+	us.dirty = true
+	us.mu.Unlock()
+}
+
+// Records returns the counters matching the filter, sorted by date, server,
+// platform and outcome.
+func (us *usageStore) Records(filter *UsageFilter) []*UsageRecord {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.records(filter)
+}
+
+// records must be called with the lock held.
+func (us *usageStore) records(filter *UsageFilter) []*UsageRecord {
+	records := make([]*UsageRecord, 0, len(us.counts))
+	for key, count := range us.counts {
+		record := &UsageRecord{Date: key.date, ServerID: key.serverID, Platform: key.platform, Outcome: key.outcome, Count: count}
+		if filter.Match(record) {
+			records = append(records, record)
+		}
+	}
+	sortUsageRecords(records)
+	return records
+}
+
+func sortUsageRecords(records []*UsageRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.ServerID != b.ServerID {
+			return a.ServerID < b.ServerID
+		}
+		if a.Platform != b.Platform {
+			return a.Platform < b.Platform
+		}
+		return a.Outcome < b.Outcome
+	})
+}
+
+// flush atomically replaces the file with the counters if they changed.
+func (us *usageStore) flush() error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if !us.dirty {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(us.records(&UsageFilter{}), "", "    ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(us.path), filepath.Base(us.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), us.path); err != nil {
+		return err
+	}
+	us.dirty = false
+	return nil
+}
+
+// startFlushing writes the counters every interval until close is called.
+func (us *usageStore) startFlushing(interval time.Duration) {
+	us.stopChan = make(chan struct{})
+	us.stopped = make(chan struct{})
+	go func() {
+		defer close(us.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := us.flush(); err != nil {
+					us.logger.Errorf("Failed to write usage counters to %v err=%v", us.path, err)
+				}
+			case <-us.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the periodic flush and writes the counters a last time.
+func (us *usageStore) close() error {
+	if us.stopChan != nil {
+		close(us.stopChan)
+		<-us.stopped
+		us.stopChan = nil
+	}
+	return us.flush()
+}
+
+// ReadUsage reads the usage records of a usage file matching the filter. A
+// missing file has no records.
+func ReadUsage(fileName string, filter *UsageFilter) ([]*UsageRecord, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var records []*UsageRecord
+	if len(buf) > 0 {
+		if err := json.Unmarshal(buf, &records); err != nil {
+			return nil, fmt.Errorf("failed to parse %v: %v", fileName, err)
+		}
+	}
+
+	matching := records[:0]
+	for _, record := range records {
+		if filter.Match(record) {
+			matching = append(matching, record)
+		}
+	}
+	sortUsageRecords(matching)
+	return matching, nil
+}
+
+// WriteUsageCSV writes the records as CSV with a header line.
+func WriteUsageCSV(w io.Writer, records []*UsageRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"date", "server_id", "platform", "outcome", "count"}); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := cw.Write([]string{record.Date, record.ServerID, record.Platform, record.Outcome, strconv.FormatInt(record.Count, 10)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// usageNotificationServer counts the outcome of every notification sent
+// through the wrapped push target, in the usage counters and in the quotas
+// of the server registry.
+type usageNotificationServer struct {
+	NotificationServer
+	pushType string
+	usage    *usageStore
+	registry *serverRegistry
+}
+
+func (u *usageNotificationServer) SendNotification(ctx context.Context, msg *PushNotification) PushResponse {
+	resp := u.NotificationServer.SendNotification(ctx, msg)
+	// A cancelled send is retried later or dead-lettered, not final.
+	if ctx.Err() == nil {
+		u.add(msg, resp)
+	}
+	return resp
+}
+
+func (u *usageNotificationServer) sendMulticast(ctx context.Context, msgs []*PushNotification) []PushResponse {
+	resps := u.NotificationServer.(multicastNotificationServer).sendMulticast(ctx, msgs)
+	if ctx.Err() == nil {
+		for i, msg := range msgs {
+			u.add(msg, resps[i])
+		}
+	}
+	return resps
+}
+
+func (u *usageNotificationServer) add(msg *PushNotification, resp PushResponse) {
+	if u.usage != nil {
+		u.usage.add(msg.ServerID, u.pushType, resp[PUSH_STATUS])
+	}
+	if u.registry != nil {
+		u.registry.add(msg.ServerID)
+	}
+}
+
+func (u *usageNotificationServer) unwrap() NotificationServer {
+	return u.NotificationServer
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := &UsageFilter{ServerID: query.Get("server_id"), From: query.Get("from"), To: query.Get("to")}
+	if err := filter.IsValid(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if s.usage == nil {
+		writeJSONError(w, http.StatusNotFound, "usage accounting is not enabled")
+		return
+	}
+
+	records := s.usage.Records(filter)
+	switch query.Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, records)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		if err := WriteUsageCSV(w, records); err != nil {
+			s.logger.Errorf("Failed to write usage CSV err=%v", err)
+		}
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be json or csv")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageAccounting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "usage.json")
+
+	cfg := &ConfigPushProxy{EnableConsoleLog: true, UsageFile: fileName}
+	srv := New(cfg, NewLogger(cfg))
+	srv.usage, err = newUsageStore(fileName, srv.logger)
+	require.NoError(t, err)
+	now := time.Date(2020, 3, 1, 23, 0, 0, 0, time.UTC)
+	srv.usage.now = func() time.Time { return now }
+
+	srv.addPushTarget("apple", &fakeNotificationServer{responses: []PushResponse{NewOkPushResponse(), NewRemovePushResponse()}}, DeliverySettings{})
+	srv.addPushTarget("android", &fakeNotificationServer{responses: []PushResponse{NewErrorPushResponse("BadTopic")}}, DeliverySettings{})
+
+	send := func(serverID, platform string) {
+		srv.sendPushNotification(context.Background(), &PushNotification{ServerID: serverID, DeviceID: "did", Platform: platform})
+	}
+	send("sid1", "apple")
+	send("sid1", "apple")
+	send("sid1", "apple")
+	send("sid2", "android")
+	now = now.Add(2 * time.Hour)
+	send("sid1", "android")
+
+	// A cancelled send is not final and not counted.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv.pushTargets["apple"].SendNotification(ctx, &PushNotification{ServerID: "sid1", DeviceID: "did"})
+
+	require.NoError(t, srv.usage.close())
+	records, err := ReadUsage(fileName, &UsageFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []*UsageRecord{
+		{Date: "2020-03-01", ServerID: "sid1", Platform: "apple", Outcome: PUSH_STATUS_OK, Count: 1},
+		{Date: "2020-03-01", ServerID: "sid1", Platform: "apple", Outcome: PUSH_STATUS_REMOVE, Count: 2},
+		{Date: "2020-03-01", ServerID: "sid2", Platform: "android", Outcome: PUSH_STATUS_FAIL, Count: 1},
+		{Date: "2020-03-02", ServerID: "sid1", Platform: "android", Outcome: PUSH_STATUS_FAIL, Count: 1},
+	}, records)
+
+	records, err = ReadUsage(fileName, &UsageFilter{ServerID: "sid1", From: "2020-03-02", To: "2020-03-31"})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "android", records[0].Platform)
+
+	t.Run("counters survive a restart", func(t *testing.T) {
+		usage, err := newUsageStore(fileName, srv.logger)
+		require.NoError(t, err)
+		usage.now = func() time.Time { return now }
+		usage.add("sid1", "android", PUSH_STATUS_FAIL)
+		records := usage.Records(&UsageFilter{From: "2020-03-02"})
+		require.Len(t, records, 1)
+		assert.Equal(t, int64(2), records[0].Count)
+	})
+
+	t.Run("export", func(t *testing.T) {
+		get := func(query string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			srv.handleUsage(w, httptest.NewRequest("GET", "/api/v1/admin/usage?"+query, nil))
+			return w
+		}
+
+		w := get("server_id=sid2&format=json")
+		require.Equal(t, http.StatusOK, w.Code)
+		var exported []*UsageRecord
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&exported))
+		require.Len(t, exported, 1)
+		assert.Equal(t, "sid2", exported[0].ServerID)
+
+		w = get("from=2020-03-02&format=csv")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "date,server_id,platform,outcome,count\n2020-03-02,sid1,android,FAIL,1\n", w.Body.String())
+
+		var buf bytes.Buffer
+		require.NoError(t, WriteUsageCSV(&buf, nil))
+		assert.Equal(t, "date,server_id,platform,outcome,count\n", buf.String())
+
+		assert.Equal(t, http.StatusBadRequest, get("from=yesterday").Code)
+		assert.Equal(t, http.StatusBadRequest, get("format=xml").Code)
+	})
+}
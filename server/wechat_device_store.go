@@ -0,0 +1,169 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultWechatDeviceMapFile = "wechat-device-ids.json"
+
+// wechatDeviceStore maps Mattermost device IDs to WeChat OpenIDs. The mapping
+// is kept in memory and persisted to a JSON file, which is only re-read when
+// it changes on disk.
+type wechatDeviceStore struct {
+	path    string
+	mu      sync.RWMutex
+	devices map[string]string
+	modTime time.Time
+	size    int64
+}
+
+func newWechatDeviceStore(path string) (*wechatDeviceStore, error) {
+	ds := &wechatDeviceStore{
+		path:    path,
+		devices: make(map[string]string),
+	}
+	if err := ds.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// reloadIfChanged re-reads the file when its size or modification time
+// differ from the last load. A missing file is an empty mapping.
+func (ds *wechatDeviceStore) reloadIfChanged() error {
+	info, err := os.Stat(ds.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ds.mu.RLock()
+	unchanged := info.ModTime().Equal(ds.modTime) && info.Size() == ds.size
+	ds.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	buf, err := ioutil.ReadFile(ds.path)
+	if err != nil {
+		return err
+	}
+	devices := make(map[string]string)
+	if len(buf) > 0 {
+		if err := json.Unmarshal(buf, &devices); err != nil {
+			return err
+		}
+	}
+	ds.devices = devices
+	ds.modTime = info.ModTime()
+	ds.size = info.Size()
+	return nil
+}
+
+// Lookup returns the OpenID bound to deviceID.
+func (ds *wechatDeviceStore) Lookup(deviceID string) (string, bool, error) {
+	if err := ds.reloadIfChanged(); err != nil {
+		return "", false, err
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	openID, ok := ds.devices[deviceID]
+	return openID, ok, nil
+}
+
+// List returns a copy of every binding.
+func (ds *wechatDeviceStore) List() (map[string]string, error) {
+	if err := ds.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	devices := make(map[string]string, len(ds.devices))
+	for deviceID, openID := range ds.devices {
+		devices[deviceID] = openID
+	}
+	return devices, nil
+}
+
+// Set binds deviceID to openID and persists the mapping.
+func (ds *wechatDeviceStore) Set(deviceID, openID string) error {
+	if err := ds.reloadIfChanged(); err != nil {
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.devices[deviceID] = openID
+	return ds.save()
+}
+
+// Remove drops the binding of deviceID and persists the mapping. It reports
+// whether there was a binding.
+func (ds *wechatDeviceStore) Remove(deviceID string) (bool, error) {
+	if err := ds.reloadIfChanged(); err != nil {
+		return false, err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.devices[deviceID]; !ok {
+		return false, nil
+	}
+	delete(ds.devices, deviceID)
+	return true, ds.save()
+}
+
+// save atomically replaces the file with the in-memory mapping. It must be
+// called with the write lock held.
+func (ds *wechatDeviceStore) save() error {
+	buf, err := json.MarshalIndent(ds.devices, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(ds.path), filepath.Base(ds.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), ds.path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(ds.path)
+	if err != nil {
+		return err
+	}
+	ds.modTime = info.ModTime()
+	ds.size = info.Size()
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWechatDeviceStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wechat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.json")
+
+	ds, err := newWechatDeviceStore(path)
+	require.NoError(t, err)
+	_, ok, err := ds.Lookup("device")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, ds.Set("device", "openid"))
+	openID, ok, err := ds.Lookup("device")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "openid", openID)
+
+	// A second store picks up changes made on disk.
+	other, err := newWechatDeviceStore(path)
+	require.NoError(t, err)
+	openID, _, _ = other.Lookup("device")
+	require.Equal(t, "openid", openID)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"device":"changed","other":"openid2"}`), 0644))
+	require.NoError(t, os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	openID, _, _ = ds.Lookup("device")
+	require.Equal(t, "changed", openID)
+
+	removed, err := ds.Remove("device")
+	require.NoError(t, err)
+	require.True(t, removed)
+	devices, err := other.List()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"other": "openid2"}, devices)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "temporary files should not be left behind")
+}
+
+func TestWechatDeviceAdminAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wechat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ds, err := newWechatDeviceStore(filepath.Join(dir, "devices.json"))
+	require.NoError(t, err)
+
+	cfg := &ConfigPushProxy{EnableConsoleLog: true, AdminToken: "secret"}
+	srv := New(cfg, NewLogger(cfg))
+	srv.wechatDevices["android_cn"] = ds
+	router := mux.NewRouter()
+	srv.initAdminRoutes(router.PathPrefix("/api/v1").Subrouter())
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		rq, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		rq.Header.Set(HEADER_AUTHORIZATION, AUTH_BEARER_PREFIX+token)
+		resp, err := http.DefaultClient.Do(rq)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/api/v1/admin/wechat/android_cn/devices", "junk", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v1/admin/wechat/junk/devices", "secret", "").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/v1/admin/wechat/android_cn/devices", "secret", `{"device_id":"d"}`).StatusCode)
+	assert.Equal(t, http.StatusOK, do("POST", "/api/v1/admin/wechat/android_cn/devices", "secret", `{"device_id":"d","openid":"o"}`).StatusCode)
+
+	openID, ok, _ := ds.Lookup("d")
+	assert.True(t, ok)
+	assert.Equal(t, "o", openID)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v1/admin/wechat/android_cn/devices/d", "secret", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/api/v1/admin/wechat/android_cn/devices/d", "secret", "").StatusCode)
+}
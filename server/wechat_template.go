@@ -0,0 +1,126 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const (
+	// Template used before the template became configurable.
+	defaultWechatTemplateID    = "3qW96y74I5Wari8oFvmu82fj9yS4LNyfPrmtLadydrI"
+	defaultWechatTemplateField = "content"
+	defaultWechatTemplateValue = "{{.SenderName}}: {{.Message}}"
+)
+
+type TemplateMiniProgram struct {
+	AppID    string `json:"appid"`
+	PagePath string `json:"pagepath,omitempty"`
+}
+
+type wechatTemplateField struct {
+	value *template.Template
+	color string
+}
+
+// wechatTemplate turns a PushNotification into a WeChat template message.
+type wechatTemplate struct {
+	templateID string
+	url        *template.Template
+	miniAppID  string
+	miniPage   *template.Template
+	fields     map[string]*wechatTemplateField
+}
+
+func newWechatTemplate(settings WechatTemplateSettings) (*wechatTemplate, error) {
+	t := &wechatTemplate{
+		templateID: settings.TemplateID,
+		fields:     make(map[string]*wechatTemplateField),
+	}
+	if t.templateID == "" {
+		t.templateID = defaultWechatTemplateID
+	}
+
+	fields := settings.Fields
+	if len(fields) == 0 {
+		fields = map[string]WechatTemplateField{
+			defaultWechatTemplateField: {Value: defaultWechatTemplateValue},
+		}
+	}
+
+	var err error
+	for keyword, field := range fields {
+		f := &wechatTemplateField{color: field.Color}
+		if f.value, err = parseWechatTemplate(keyword, field.Value); err != nil {
+			return nil, err
+		}
+		t.fields[keyword] = f
+	}
+
+	if t.url, err = parseWechatTemplate("url", settings.URL); err != nil {
+		return nil, err
+	}
+	if settings.MiniProgram != nil {
+		if settings.MiniProgram.AppID == "" {
+			return nil, fmt.Errorf("wechat template mini program is missing AppID")
+		}
+		t.miniAppID = settings.MiniProgram.AppID
+		if t.miniPage, err = parseWechatTemplate("pagepath", settings.MiniProgram.PagePath); err != nil {
+			return nil, err
+		}
+	}
+
+	// Render once so that unknown PushNotification fields fail at startup.
+	if _, err = t.Message("", &PushNotification{}); err != nil {
+		return nil, fmt.Errorf("invalid wechat template: %v", err)
+	}
+	return t, nil
+}
+
+func parseWechatTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wechat template %v: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+func executeWechatTemplate(tmpl *template.Template, msg *PushNotification) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, msg); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// Message builds the template message addressed to openID.
+func (t *wechatTemplate) Message(openID string, msg *PushNotification) (*TemplateMsg, error) {
+	message := &TemplateMsg{
+		Touser:      openID,
+		Template_id: t.templateID,
+		Data:        make(map[string]*KeyWordData, len(t.fields)),
+	}
+
+	for keyword, field := range t.fields {
+		value, err := executeWechatTemplate(field.value, msg)
+		if err != nil {
+			return nil, err
+		}
+		message.Data[keyword] = &KeyWordData{Value: value, Color: field.color}
+	}
+
+	var err error
+	if message.Url, err = executeWechatTemplate(t.url, msg); err != nil {
+		return nil, err
+	}
+	if t.miniAppID != "" {
+		message.MiniProgram = &TemplateMiniProgram{AppID: t.miniAppID}
+		if message.MiniProgram.PagePath, err = executeWechatTemplate(t.miniPage, msg); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
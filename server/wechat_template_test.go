@@ -0,0 +1,52 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWechatTemplate(t *testing.T) {
+	msg := &PushNotification{SenderName: "alice", Message: "hello", ChannelName: "town-square", ChannelID: "channel"}
+
+	tmpl, err := newWechatTemplate(WechatTemplateSettings{})
+	require.NoError(t, err)
+	message, err := tmpl.Message("openid", msg)
+	require.NoError(t, err)
+	require.Equal(t, defaultWechatTemplateID, message.Template_id)
+	require.Equal(t, "openid", message.Touser)
+	require.Equal(t, "alice: hello", message.Data["content"].Value)
+	require.Empty(t, message.Url)
+	require.Nil(t, message.MiniProgram)
+
+	tmpl, err = newWechatTemplate(WechatTemplateSettings{
+		TemplateID:  "template",
+		URL:         "https://chat.example.com/channels/{{.ChannelID}}",
+		MiniProgram: &WechatMiniProgramSettings{AppID: "app", PagePath: "pages/channel?id={{.ChannelID}}"},
+		Fields: map[string]WechatTemplateField{
+			"first":    {Value: "{{.ChannelName}}", Color: "#173177"},
+			"keyword1": {Value: "{{.SenderName}}"},
+			"keyword2": {Value: "{{.Message}}"},
+		},
+	})
+	require.NoError(t, err)
+	message, err = tmpl.Message("openid", msg)
+	require.NoError(t, err)
+	require.Equal(t, "template", message.Template_id)
+	require.Equal(t, "https://chat.example.com/channels/channel", message.Url)
+	require.Equal(t, &TemplateMiniProgram{AppID: "app", PagePath: "pages/channel?id=channel"}, message.MiniProgram)
+	require.Equal(t, &KeyWordData{Value: "town-square", Color: "#173177"}, message.Data["first"])
+	require.Equal(t, "alice", message.Data["keyword1"].Value)
+	require.Equal(t, "hello", message.Data["keyword2"].Value)
+
+	_, err = newWechatTemplate(WechatTemplateSettings{Fields: map[string]WechatTemplateField{"first": {Value: "{{.Junk"}}})
+	require.Error(t, err)
+	_, err = newWechatTemplate(WechatTemplateSettings{MiniProgram: &WechatMiniProgramSettings{}})
+	require.Error(t, err)
+
+	_, err = newWechatTemplate(WechatTemplateSettings{Fields: map[string]WechatTemplateField{"first": {Value: "{{.Junk}}"}}})
+	require.Error(t, err)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wechatAPIURL = "https://api.weixin.qq.com"
+
+	// WeChat errcodes telling the access token is invalid or expired.
+	WechatErrInvalidToken = 40001
+	WechatErrExpiredToken = 42001
+
+	// WeChat errcodes telling the OpenID will never receive messages again.
+	WechatErrInvalidOpenID = 40003
+	WechatErrUnsubscribed  = 43004
+	WechatErrUserRefused   = 43101
+
+	// WeChat errcode asking to try again later.
+	WechatErrSystemBusy = -1
+
+	// Tokens are refreshed this long before WeChat says they expire.
+	wechatTokenExpiryMargin = 5 * time.Minute
+)
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	ErrCode     int    `json:"errcode"`
+	ErrMsg      string `json:"errmsg"`
+}
+
+// wechatTokenManager caches the access token of one WeChat app. Only one
+// refresh runs at a time; concurrent callers wait for it and share the result.
+type wechatTokenManager struct {
+	appID   string
+	secret  string
+	apiURL  string
+	client  *http.Client
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newWechatTokenManager(key, apiURL string, client *http.Client) (*wechatTokenManager, error) {
+	idSec := strings.SplitN(key, ":", 2)
+	if len(idSec) != 2 || idSec[0] == "" || idSec[1] == "" {
+		return nil, errors.New("wechat key must be formatted as appid:secret")
+	}
+	return &wechatTokenManager{
+		appID:  idSec[0],
+		secret: idSec[1],
+		apiURL: apiURL,
+		client: client,
+	}, nil
+}
+
+// Token returns the cached access token, fetching a new one when it is
+// missing or about to expire.
+func (tm *wechatTokenManager) Token(ctx context.Context) (string, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.token != "" && time.Now().Before(tm.expires) {
+		return tm.token, nil
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "client_credential")
+	params.Set("appid", tm.appID)
+	params.Set("secret", tm.secret)
+	req, err := http.NewRequestWithContext(ctx, "GET", tm.apiURL+"/cgi-bin/token?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := tm.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var response TokenResponse
+	if err = json.Unmarshal(respBody, &response); err != nil {
+		return "", newStatusEndpointError(resp.StatusCode, fmt.Sprintf("wechat token code=%v err=%v", resp.StatusCode, err))
+	}
+	if response.ErrCode != 0 || response.AccessToken == "" {
+		return "", &endpointError{
+			msg:       fmt.Sprintf("wechat token errcode=%v errmsg=%v", response.ErrCode, response.ErrMsg),
+			transient: response.ErrCode == WechatErrSystemBusy,
+		}
+	}
+
+	expiresIn := time.Duration(response.ExpiresIn) * time.Second
+	if expiresIn > 2*wechatTokenExpiryMargin {
+		expiresIn -= wechatTokenExpiryMargin
+	} else {
+		expiresIn /= 2
+	}
+	tm.token = response.AccessToken
+	tm.expires = time.Now().Add(expiresIn)
+	return tm.token, nil
+}
+
+// Invalidate drops token if it is still the cached one, so that a token
+// rejected by WeChat is not handed out again.
+func (tm *wechatTokenManager) Invalidate(token string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.token == token {
+		tm.token = ""
+	}
+}
+
+func isWechatTokenError(errCode int) bool {
+	return errCode == WechatErrInvalidToken || errCode == WechatErrExpiredToken
+}
+
+func isWechatRemoveError(errCode int) bool {
+	return errCode == WechatErrInvalidOpenID || errCode == WechatErrUnsubscribed || errCode == WechatErrUserRefused
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWechatTokenManager(t *testing.T) {
+	var tokenRequests, sendRequests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "appid", r.URL.Query().Get("appid"))
+		assert.Equal(t, "secret", r.URL.Query().Get("secret"))
+		n := atomic.AddInt32(&tokenRequests, 1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":7200}`, n)
+	})
+	mux.HandleFunc("/cgi-bin/message/template/send", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sendRequests, 1)
+		if r.URL.Query().Get("access_token") == "token1" {
+			_, _ = w.Write([]byte(`{"errcode":40001,"errmsg":"invalid credential"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	_, err := newWechatTokenManager("junk", ts.URL, http.DefaultClient)
+	require.Error(t, err)
+
+	tm, err := newWechatTokenManager("appid:secret", ts.URL, http.DefaultClient)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := tm.Token(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, "token1", token)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&tokenRequests), "only one refresh should happen")
+	require.True(t, tm.expires.Before(time.Now().Add(7200*time.Second-wechatTokenExpiryMargin+time.Second)))
+
+	srv := NewAndroidNotificationServerW(AndroidPushSettings{Type: "android", AndroidAPIKey: "appid:secret"}, NewLogger(&ConfigPushProxy{EnableConsoleLog: true}), nil).(*AndroidNotificationServerW)
+	srv.apiURL = ts.URL
+	srv.tokens = tm
+
+	resp, err := srv.sendTemplateMessage(context.Background(), []byte(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, 0, resp.ErrCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(&sendRequests), "send should be retried once")
+	require.Equal(t, int32(2), atomic.LoadInt32(&tokenRequests))
+}